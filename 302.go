@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"net/http"
+	"fmt"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/goccy/go-yaml"
 	"github.com/juju/loggo"
+	"github.com/mirrorz-org/mirrorz-302/pkg/activation"
 	"github.com/mirrorz-org/mirrorz-302/pkg/geo"
+	"github.com/mirrorz-org/mirrorz-302/pkg/mirrorzdb"
 	"github.com/mirrorz-org/mirrorz-302/pkg/server"
 )
 
@@ -18,28 +24,133 @@ var logger = loggo.GetLogger("<root>")
 func LoadConfig(path string) (config server.Config, err error) {
 	file, err := os.ReadFile(path)
 	if err != nil {
-		logger.Errorf("LoadConfig ReadFile failed: %v\n", err)
 		return
 	}
-	err = yaml.Unmarshal(file, &config)
-	if err != nil {
-		logger.Errorf("LoadConfig json Unmarshal failed: %v\n", err)
+	// unknown keys are rejected, as they are mostly misspelled ones
+	if err = yaml.UnmarshalWithOptions(file, &config, yaml.Strict()); err != nil {
+		err = fmt.Errorf("%s:\n%s", path, yaml.FormatError(err, false, true))
+		return
+	}
+	if err = config.Validate(); err != nil {
+		err = fmt.Errorf("%s:\n%w", path, err)
 		return
 	}
 	logger.Debugf("LoadConfig InfluxDB URL: %s\n", config.InfluxDB.URL)
 	logger.Debugf("LoadConfig InfluxDB Org: %s\n", config.InfluxDB.Org)
 	logger.Debugf("LoadConfig InfluxDB Bucket: %s\n", config.InfluxDB.Bucket)
+	logger.Debugf("LoadConfig Status Source: %s\n", config.StatusSource)
+	logger.Debugf("LoadConfig Status File: %s\n", config.StatusFile)
+	logger.Debugf("LoadConfig Prefetch Interval: %d\n", config.PrefetchInterval)
+	logger.Debugf("LoadConfig Max Staleness: %d\n", config.MaxStaleness)
+	logger.Debugf("LoadConfig Query Timeout: %d\n", config.QueryTimeout)
+	logger.Debugf("LoadConfig Breaker Threshold: %d\n", config.BreakerThreshold)
+	logger.Debugf("LoadConfig Breaker Cooldown: %d\n", config.BreakerCooldown)
+	logger.Debugf("LoadConfig Max Age: %d\n", config.MaxAge)
+	logger.Debugf("LoadConfig Skip Status: %v\n", config.SkipStatus)
+	logger.Debugf("LoadConfig Geo Provider: %s\n", config.GeoProvider)
 	logger.Debugf("LoadConfig IPDB File: %s\n", config.IPDBFile)
+	logger.Debugf("LoadConfig MMDB File: %s\n", config.MMDBFile)
+	logger.Debugf("LoadConfig ASN DB File: %s\n", config.ASNDBFile)
+	logger.Debugf("LoadConfig Geo Table File: %s\n", config.GeoTableFile)
+	logger.Debugf("LoadConfig ISP File: %s\n", config.ISPFile)
 	logger.Debugf("LoadConfig HTTP Bind Address: %s\n", config.HTTPBindAddress)
+	logger.Debugf("LoadConfig HTTPS Bind Address: %s\n", config.HTTPSBindAddress)
+	logger.Debugf("LoadConfig TLS Cert File: %s\n", config.TLSCertFile)
+	logger.Debugf("LoadConfig TLS Key File: %s\n", config.TLSKeyFile)
+	logger.Debugf("LoadConfig Shutdown Timeout: %d\n", config.ShutdownTimeout)
+	logger.Debugf("LoadConfig Trusted Proxies: %v\n", config.TrustedProxies)
+	logger.Debugf("LoadConfig Proxy Protocol: %t\n", config.ProxyProtocol)
 	logger.Debugf("LoadConfig MirrorZ D Directory: %s\n", config.MirrorZDDirectory)
+	logger.Debugf("LoadConfig MirrorZ D Error Threshold: %d\n", config.MirrorZDThreshold)
+	logger.Debugf("LoadConfig Label Conflict: %s\n", config.LabelConflict)
 	logger.Debugf("LoadConfig Homepage: %s\n", config.Homepage)
 	logger.Debugf("LoadConfig Domain Length: %d\n", config.DomainLength)
 	logger.Debugf("LoadConfig Cache Time: %d\n", config.CacheTime)
 	logger.Debugf("LoadConfig Log Directory: %s\n", config.LogDirectory)
+	logger.Debugf("LoadConfig Watch Files: %t\n", config.WatchFiles)
 	return
 }
 
+// check validates a config and the files it refers to, without starting the server.
+func check(args []string) {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	configPtr := flags.String("config", "config.yml", "path to config file")
+	flags.Parse(args)
+
+	config, err := LoadConfig(*configPtr)
+	if err == nil {
+		err = server.Check(config)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: OK\n", *configPtr)
+}
+
+// lint reports the problems in mirrorz.d files, given a directory or the config using it.
+func lint(args []string) {
+	flags := flag.NewFlagSet("lint", flag.ExitOnError)
+	configPtr := flags.String("config", "", "path to config file, for its mirrorz.d directory and geo tables")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s lint [-config file] [directory]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	dir := flags.Arg(0)
+	if *configPtr != "" {
+		config, err := LoadConfig(*configPtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		if config.GeoTableFile != "" {
+			if err := geo.LoadGeoTable(config.GeoTableFile); err != nil {
+				fmt.Fprintf(os.Stderr, "geo-table-file: %v\n", err)
+			}
+		}
+		if config.ISPFile != "" {
+			if err := geo.LoadISPCatalogue(config.ISPFile); err != nil {
+				fmt.Fprintf(os.Stderr, "isp-file: %v\n", err)
+			}
+		}
+		if dir == "" {
+			dir = config.MirrorZDDirectory
+		}
+	}
+	if dir == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	warnings, err := mirrorzdb.Lint(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	for _, w := range warnings {
+		fmt.Println(w)
+	}
+	if len(warnings) > 0 {
+		os.Exit(1)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check":
+			loggo.ConfigureLoggers("<root>=CRITICAL")
+			check(os.Args[2:])
+			return
+		case "lint":
+			loggo.ConfigureLoggers("<root>=CRITICAL")
+			lint(os.Args[2:])
+			return
+		}
+	}
+
 	configPtr := flag.String("config", "config.yml", "path to config file")
 	debugPtr := flag.Bool("debug", false, "debug mode")
 	flag.Parse()
@@ -52,19 +163,38 @@ func main() {
 
 	config, err := LoadConfig(*configPtr)
 	if err != nil {
-		logger.Errorf("Cannot open config file: %v\n", err)
+		logger.Errorf("Cannot load config file: %v\n", err)
 		os.Exit(1)
 	}
 
-	if config.IPDBFile != "" {
-		geo.LoadIPDB(config.IPDBFile)
+	if config.ASNDBFile != "" {
+		if err := geo.LoadASNDB(config.ASNDBFile); err != nil {
+			logger.Errorf("Cannot load ASN database: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
-	s := server.NewServer(config)
+	s, err := server.NewServer(config)
+	if err != nil {
+		logger.Errorf("Cannot create server: %v\n", err)
+		os.Exit(1)
+	}
+	if err := s.LoadGeo(); err != nil {
+		logger.Errorf("Cannot load geo database, using placeholder data: %v\n", err)
+	}
 	if err := s.LoadMirrorZD(); err != nil {
 		logger.Errorf("Cannot load mirrorz.d.json: %v\n", err)
 		os.Exit(1)
 	}
+	if err := s.LoadStatus(); err != nil {
+		logger.Errorf("Cannot load status file: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := s.LoadTLS(); err != nil {
+		logger.Errorf("Cannot load TLS certificate: %v\n", err)
+		os.Exit(1)
+	}
 
 	// Logfile (or its directory) must be unprivilegd
 	err = s.InitLoggers()
@@ -80,10 +210,30 @@ func main() {
 			switch sig {
 			case syscall.SIGHUP:
 				logger.Infof("Got A HUP Signal! Now Reloading mirrorz.d.json....\n")
+				// Geo data first, mirrorz.d is checked against the geo tables and ISP catalogue
+				if err := s.LoadGeo(); err != nil {
+					logger.Errorf("Error reloading geo database: %v\n", err)
+				}
 				s.LoadMirrorZD()
+				if err := s.LoadStatus(); err != nil {
+					logger.Errorf("Error reloading status file: %v\n", err)
+				}
+				if err := s.LoadTLS(); err != nil {
+					logger.Errorf("Error reloading TLS certificate: %v\n", err)
+				}
 			case syscall.SIGUSR1:
 				logger.Infof("Got A USR1 Signal! Now Reloading config.json....\n")
-				LoadConfig(*configPtr)
+				newConfig, err := LoadConfig(*configPtr)
+				if err != nil {
+					logger.Errorf("Error reloading config file, keeping the current one: %v\n", err)
+					break
+				}
+				notApplied, err := s.ApplyConfig(newConfig)
+				if err != nil {
+					logger.Errorf("Error applying config, keeping the current one: %v\n", err)
+				} else if len(notApplied) > 0 {
+					logger.Warningf("Restart required to apply: %s\n", strings.Join(notApplied, ", "))
+				}
 			case syscall.SIGUSR2:
 				logger.Infof("Got A USR2 Signal! Now Reopen log file....\n")
 				err := s.InitLoggers()
@@ -98,7 +248,65 @@ func main() {
 	}()
 
 	s.StartResolvedTicker()
+	s.StartPrefetch()
+	if err := s.StartWatchers(); err != nil {
+		logger.Errorf("Cannot watch files: %v\n", err)
+	}
+
+	inherited, err := activation.Listeners()
+	if err != nil {
+		logger.Errorf("Cannot use inherited sockets: %v\n", err)
+		os.Exit(1)
+	}
+	serveErr := make(chan error, 2+len(inherited))
+	serve := func(ln net.Listener) {
+		go func() { serveErr <- s.Serve(ln) }()
+	}
+	for _, l := range inherited {
+		// Sockets named "https" (FileDescriptorName=https) serve HTTPS, others HTTP
+		ln, err := s.WrapListener(l, l.Name == "https")
+		if err != nil {
+			logger.Errorf("Cannot use inherited socket %s: %v\n", l.Name, err)
+			os.Exit(1)
+		}
+		logger.Infof("Starting server on inherited socket %s (%s)\n", l.Addr(), l.Name)
+		serve(ln)
+	}
+	if len(inherited) == 0 && config.HTTPBindAddress != "" {
+		ln, err := s.Listen(config.HTTPBindAddress)
+		if err != nil {
+			logger.Errorf("Cannot listen on %s: %v\n", config.HTTPBindAddress, err)
+			os.Exit(1)
+		}
+		logger.Infof("Starting HTTP server on %s\n", config.HTTPBindAddress)
+		serve(ln)
+	}
+	if len(inherited) == 0 && config.HTTPSBindAddress != "" {
+		ln, err := s.ListenTLS(config.HTTPSBindAddress)
+		if err != nil {
+			logger.Errorf("Cannot listen on %s: %v\n", config.HTTPSBindAddress, err)
+			os.Exit(1)
+		}
+		logger.Infof("Starting HTTPS server on %s\n", config.HTTPSBindAddress)
+		serve(ln)
+	}
 
-	logger.Infof("Starting HTTP server on %s\n", config.HTTPBindAddress)
-	logger.Errorf("HTTP Server error: %v\n", http.ListenAndServe(config.HTTPBindAddress, s))
+	stopChannel := make(chan os.Signal, 1)
+	signal.Notify(stopChannel, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-serveErr:
+		logger.Errorf("HTTP Server error: %v\n", err)
+		os.Exit(1)
+	case sig := <-stopChannel:
+		timeout := time.Duration(config.ShutdownTimeout) * time.Second
+		if config.ShutdownTimeout == 0 {
+			timeout = server.DefaultShutdownTimeout
+		}
+		logger.Infof("Got %v! Now shutting down, waiting up to %s....\n", sig, timeout)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			logger.Errorf("Error shutting down: %v\n", err)
+		}
+	}
 }
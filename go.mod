@@ -3,12 +3,13 @@ module github.com/mirrorz-org/mirrorz-302
 go 1.22
 
 require (
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/goccy/go-yaml v1.19.2
-	github.com/influxdata/influxdb v1.11.5
 	github.com/influxdata/influxdb-client-go/v2 v2.13.0
 	github.com/ipipdotnet/ipdb-go v1.3.3
 	github.com/juju/loggo v1.0.0
-	github.com/stretchr/testify v1.8.4
+	github.com/oschwald/maxminddb-golang v1.13.1
+	github.com/stretchr/testify v1.9.0
 )
 
 require (
@@ -19,5 +20,6 @@ require (
 	github.com/oapi-codegen/runtime v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
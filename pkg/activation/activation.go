@@ -0,0 +1,60 @@
+// Package activation receives listening sockets passed by systemd socket activation
+// (sd_listen_fds(3)) or any supervisor following the same LISTEN_FDS protocol.
+package activation
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed, after stdin, stdout and stderr.
+const listenFDsStart = 3
+
+// A Listener is an inherited listening socket.
+type Listener struct {
+	net.Listener
+	Name string // from LISTEN_FDNAMES, e.g. FileDescriptorName= in the systemd socket unit
+}
+
+// Listeners returns the listening sockets passed to this process, if any.
+//
+// The environment variables are unset, so that child processes do not inherit them.
+func Listeners() ([]Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make([]Listener, 0, n)
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("activation: fd %d (%s): %w", listenFDsStart+i, name, err)
+		}
+		listeners = append(listeners, Listener{Listener: ln, Name: name})
+	}
+	return listeners, nil
+}
@@ -0,0 +1,26 @@
+package activation
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenersNotActivated(t *testing.T) {
+	as := assert.New(t)
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	listeners, err := Listeners()
+	as.Nil(err)
+	as.Empty(listeners)
+	_, ok := os.LookupEnv("LISTEN_FDS")
+	as.False(ok, "LISTEN_FDS should be unset")
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "0")
+	listeners, err = Listeners()
+	as.Nil(err)
+	as.Empty(listeners)
+}
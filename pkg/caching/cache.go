@@ -2,6 +2,7 @@ package caching
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mirrorz-org/mirrorz-302/pkg/logging"
@@ -28,26 +29,51 @@ type Resolved struct {
 }
 
 type ResolveCache struct {
-	m      sync.Map // map[string]Resolved
-	ttl    time.Duration
-	ticker *time.Ticker
+	m   sync.Map // map[string]Resolved
+	ttl atomic.Int64
+
+	mu   sync.Mutex
+	stop chan struct{} // stops the GC ticker
 }
 
+// minGCInterval is the GC interval for caches with a shorter TTL.
+const minGCInterval = time.Minute
+
 func NewResolveCache(ttl time.Duration) *ResolveCache {
-	return &ResolveCache{ttl: ttl}
+	c := new(ResolveCache)
+	c.ttl.Store(int64(ttl))
+	return c
+}
+
+// TTL returns the time to live of cached results.
+func (c *ResolveCache) TTL() time.Duration {
+	return time.Duration(c.ttl.Load())
+}
+
+// SetTTL changes the time to live of cached results,
+// restarting the GC ticker with the new interval if it is running.
+func (c *ResolveCache) SetTTL(ttl time.Duration) {
+	c.ttl.Store(int64(ttl))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stop != nil {
+		c.stopGCTicker()
+		c.startGCTicker()
+	}
 }
 
 func (c *ResolveCache) Load(key string) (Resolved, Status) {
 	cur := time.Now()
+	ttl := c.TTL()
 	v, ok := c.m.Load(key)
 	if !ok {
 		return Resolved{}, StatusNone
 	}
 	r := v.(Resolved)
-	if cur.Sub(r.last) >= c.ttl {
+	if cur.Sub(r.last) >= ttl {
 		return r, StatusExpired
 	}
-	if cur.Sub(r.start) >= c.ttl {
+	if cur.Sub(r.start) >= ttl {
 		return r, StatusStale
 	}
 	return r, StatusFresh
@@ -76,13 +102,14 @@ func (c *ResolveCache) Touch(key string) {
 
 func (c *ResolveCache) GC(cur time.Time) {
 	cacheGCLogger.Infof("Resolved GC start at %s\n", cur)
+	ttl := c.TTL()
 	c.m.Range(func(k, v any) bool {
 		r, ok := v.(Resolved)
 		if !ok {
 			c.m.Delete(k)
 			return true
 		}
-		if cur.Sub(r.start) >= c.ttl && cur.Sub(r.last) >= c.ttl {
+		if cur.Sub(r.start) >= ttl && cur.Sub(r.last) >= ttl {
 			c.m.Delete(k)
 			cacheGCLogger.Infof("Resolved GC %s: %s\n", k, r.Url)
 		}
@@ -91,27 +118,49 @@ func (c *ResolveCache) GC(cur time.Time) {
 	cacheGCLogger.Infof("Resolved GC done at %s\n\n", time.Now())
 }
 
-func (c *ResolveCache) gcTicker(ch <-chan time.Time) {
-	for t := range ch {
-		c.GC(t)
+func (c *ResolveCache) gcTicker(ticker *time.Ticker, stop <-chan struct{}) {
+	defer ticker.Stop()
+	for {
+		select {
+		case t := <-ticker.C:
+			c.GC(t)
+		case <-stop:
+			return
+		}
 	}
 }
 
+// StartGCTicker removes expired results every TTL in the background.
 func (c *ResolveCache) StartGCTicker() {
-	if c.ticker != nil {
-		return
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stop == nil {
+		c.startGCTicker()
 	}
-	c.ticker = time.NewTicker(time.Second * time.Duration(c.ttl))
-	go c.gcTicker(c.ticker.C)
+}
+
+func (c *ResolveCache) startGCTicker() {
+	interval := c.TTL()
+	if interval < minGCInterval {
+		interval = minGCInterval
+	}
+	c.stop = make(chan struct{})
+	go c.gcTicker(time.NewTicker(interval), c.stop)
 }
 
 func (c *ResolveCache) StopGCTicker() {
-	if c.ticker != nil {
-		c.ticker.Stop()
-		c.ticker = nil
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stop != nil {
+		c.stopGCTicker()
 	}
 }
 
+func (c *ResolveCache) stopGCTicker() {
+	close(c.stop)
+	c.stop = nil
+}
+
 func (c *ResolveCache) Clear() {
 	c.m.Range(func(k, v any) bool {
 		c.m.Delete(k)
@@ -24,3 +24,19 @@ func TestResolveCache(t *testing.T) {
 	as.Equal(r.start, r2.start)
 	as.Equal(StatusStale, status)
 }
+
+func TestResolveCacheSetTTL(t *testing.T) {
+	as := assert.New(t)
+	c := NewResolveCache(10 * time.Second)
+	c.StartGCTicker()
+	defer c.StopGCTicker()
+
+	c.Store("a", Resolved{start: time.Now().Add(-time.Minute)})
+	_, status := c.Load("a")
+	as.Equal(StatusStale, status)
+
+	c.SetTTL(time.Hour)
+	as.Equal(time.Hour, c.TTL())
+	_, status = c.Load("a")
+	as.Equal(StatusFresh, status)
+}
@@ -0,0 +1,141 @@
+package geo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// prefixTable maps IP prefixes of one address family to AS numbers.
+type prefixTable struct {
+	// prefixes[n] maps the first n bits of an IP to an ASN
+	prefixes map[int]map[string]uint32
+	// lengths lists the keys of prefixes, longest first
+	lengths []int
+}
+
+func (t *prefixTable) insert(ipnet *net.IPNet, asn uint32) {
+	ones, _ := ipnet.Mask.Size()
+	if t.prefixes == nil {
+		t.prefixes = make(map[int]map[string]uint32)
+	}
+	m, ok := t.prefixes[ones]
+	if !ok {
+		m = make(map[string]uint32)
+		t.prefixes[ones] = m
+		t.lengths = append(t.lengths, ones)
+		sort.Sort(sort.Reverse(sort.IntSlice(t.lengths)))
+	}
+	m[string(ipnet.IP)] = asn
+}
+
+// lookup returns the ASN of the longest prefix containing ip,
+// which must have the same length as the prefixes.
+func (t *prefixTable) lookup(ip net.IP) uint32 {
+	for _, ones := range t.lengths {
+		masked := ip.Mask(net.CIDRMask(ones, len(ip)*8))
+		if asn, ok := t.prefixes[ones][string(masked)]; ok {
+			return asn
+		}
+	}
+	return 0
+}
+
+// asnTable maps IP prefixes to AS numbers.
+type asnTable struct {
+	v4, v6 prefixTable
+}
+
+var asnDB atomic.Pointer[asnTable]
+
+// ParseASN parses an AS number like "AS4134" or "4134".
+func ParseASN(s string) (uint32, error) {
+	if len(s) >= 2 && strings.EqualFold(s[:2], "AS") {
+		s = s[2:]
+	}
+	asn, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ASN %q", s)
+	}
+	return uint32(asn), nil
+}
+
+// readASNTable reads a prefix-to-ASN text dump.
+//
+// Each line holds a CIDR prefix and an AS number separated by whitespace,
+// e.g. "1.0.0.0/24 13335" or "2001:da8::/32\tAS4538".
+// Empty lines and lines starting with "#" or ";" are ignored.
+func readASNTable(r io.Reader) (*asnTable, error) {
+	t := new(asnTable)
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected prefix and ASN", lineno)
+		}
+		_, ipnet, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		asn, err := ParseASN(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		if len(ipnet.IP) == net.IPv4len {
+			t.v4.insert(ipnet, asn)
+		} else {
+			t.v6.insert(ipnet, asn)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// lookup returns the ASN of the longest prefix containing ip.
+func (t *asnTable) lookup(ip net.IP) uint32 {
+	if ip4 := ip.To4(); ip4 != nil {
+		return t.v4.lookup(ip4)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		return t.v6.lookup(ip16)
+	}
+	return 0
+}
+
+// LoadASNDB loads a new prefix-to-ASN database from a text dump.
+func LoadASNDB(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	t, err := readASNTable(f)
+	if err != nil {
+		return fmt.Errorf("LoadASNDB %s: %w", filename, err)
+	}
+	asnDB.Store(t)
+	return nil
+}
+
+// LookupASN returns the AS number of an IP address.
+// If no database is loaded or the IP is not found, 0 is returned.
+func LookupASN(ip net.IP) uint32 {
+	t := asnDB.Load()
+	if t == nil || ip == nil {
+		return 0
+	}
+	return t.lookup(ip)
+}
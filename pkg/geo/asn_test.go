@@ -0,0 +1,54 @@
+package geo
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testASNTable = `# prefix asn
+1.0.0.0/24	13335
+202.0.0.0/16 4538
+202.0.1.0/24 AS4134
+
+2001:da8::/32 4538
+2001:da8:d800::/48 as24362
+`
+
+func TestASNTable(t *testing.T) {
+	as := assert.New(t)
+	table, err := readASNTable(strings.NewReader(testASNTable))
+	as.Nil(err)
+
+	for ip, asn := range map[string]uint32{
+		"1.0.0.1":         13335,
+		"202.0.2.1":       4538,
+		"202.0.1.1":       4134, // longest prefix wins
+		"8.8.8.8":         0,
+		"2001:da8::1":     4538,
+		"2001:da8:d800::": 24362,
+		"2001:db8::1":     0,
+		"::ffff:1.0.0.1":  13335,
+	} {
+		as.Equalf(asn, table.lookup(net.ParseIP(ip)), "lookup %s", ip)
+	}
+
+	_, err = readASNTable(strings.NewReader("1.0.0.0/24\n"))
+	as.NotNil(err)
+	_, err = readASNTable(strings.NewReader("1.0.0.0/33 1\n"))
+	as.NotNil(err)
+}
+
+func TestParseASN(t *testing.T) {
+	as := assert.New(t)
+	asn, err := ParseASN("AS4134")
+	as.Nil(err)
+	as.Equal(uint32(4134), asn)
+	asn, err = ParseASN("4538")
+	as.Nil(err)
+	as.Equal(uint32(4538), asn)
+	_, err = ParseASN("ASX")
+	as.NotNil(err)
+}
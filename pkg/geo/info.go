@@ -1,12 +1,19 @@
 package geo
 
-import "math"
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
 
 type GeoInfo struct {
 	Name                string
 	Latitude, Longitude float64
 }
 
+// codeToInfo holds the built-in regions, which a loaded table can extend.
+// Use GetGeoInfo to look up the current table.
 var codeToInfo = map[string]GeoInfo{
 	"BJ": {"北京", 39.90403, 116.40753},
 	"TJ": {"天津", 39.1467, 117.2056},
@@ -44,45 +51,42 @@ var codeToInfo = map[string]GeoInfo{
 	"MO": {"澳门", 22.166667, 113.55},
 }
 
-var nameToCode = make(map[string]string, len(codeToInfo))
-
-var ispCodeToName = map[string]string{
-	"CERNET":   "教育网",
-	"CMCC":     "移动",
-	"CHINANET": "电信",
-	"UNICOM":   "联通",
-	"CSTNET":   "科技网",
-	"DRPENG":   "鹏博士",
-	"CBNET":    "广电网",
-}
-
-var ispNameToCode = make(map[string]string, len(ispCodeToName))
-
-func init() {
-	for k, v := range codeToInfo {
-		nameToCode[v.Name] = k
-	}
-	for k, v := range ispCodeToName {
-		ispNameToCode[v] = k
-	}
+// countryNameToCode maps the Chinese country names used by IPIP
+// to ISO 3166-1 alpha-2 codes, for databases without the country_code field.
+var countryNameToCode = map[string]string{
+	"中国":   "CN",
+	"美国":   "US",
+	"日本":   "JP",
+	"韩国":   "KR",
+	"新加坡":  "SG",
+	"德国":   "DE",
+	"英国":   "GB",
+	"法国":   "FR",
+	"俄罗斯":  "RU",
+	"加拿大":  "CA",
+	"澳大利亚": "AU",
+	"荷兰":   "NL",
 }
 
 // GetGeoInfo returns the GeoInfo of a given code.
 func GetGeoInfo(code string) (GeoInfo, bool) {
-	info, ok := codeToInfo[code]
+	info, ok := currentTable.Load().codeToInfo[code]
 	return info, ok
 }
 
-// NameToCode looks up the code of a given location name.
+// NameToCode looks up the code of a given location name or alias, ignoring case.
 // If the name is not found, an empty string is returned.
 func NameToCode(name string) string {
-	return nameToCode[name]
+	return currentTable.Load().nameToCode[nameKey(name)]
 }
 
-// ISPNameToCode looks up the code of a given ISP name.
-// If the name is not found, an empty string is returned.
-func ISPNameToCode(name string) string {
-	return ispNameToCode[name]
+// CountryCode returns the ISO 3166-1 alpha-2 code of the country in a CityInfo.
+// If the country is unknown, an empty string is returned.
+func CountryCode(info *CityInfo) string {
+	if len(info.CountryCode) == 2 {
+		return strings.ToUpper(info.CountryCode)
+	}
+	return countryNameToCode[info.CountryName]
 }
 
 // The radius of the Earth in kilometres.
@@ -107,6 +111,48 @@ func Haversine(lat1, long1, lat2, long2 float64) float64 {
 	return EarthRadius * c
 }
 
+// A Point is a position on the Earth, in degrees.
+type Point struct {
+	Latitude, Longitude float64
+}
+
+// NewPoint returns a Point if the coordinates are within range.
+func NewPoint(lat, long float64) (Point, error) {
+	if math.IsNaN(lat) || math.IsNaN(long) || math.Abs(lat) > 90 || math.Abs(long) > 180 {
+		return Point{}, fmt.Errorf("coordinates out of range: %v,%v", lat, long)
+	}
+	return Point{lat, long}, nil
+}
+
+// ParsePoint parses a position like "39.9,116.4" (latitude first).
+func ParsePoint(s string) (Point, error) {
+	latString, longString, ok := strings.Cut(s, ",")
+	if !ok {
+		return Point{}, fmt.Errorf("invalid coordinates %q", s)
+	}
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(latString), 64)
+	long, err2 := strconv.ParseFloat(strings.TrimSpace(longString), 64)
+	if err1 != nil || err2 != nil {
+		return Point{}, fmt.Errorf("invalid coordinates %q", s)
+	}
+	return NewPoint(lat, long)
+}
+
+// DistanceTo returns the distance to another point in kilometres.
+func (p Point) DistanceTo(q Point) float64 {
+	return Haversine(p.Latitude, p.Longitude, q.Latitude, q.Longitude)
+}
+
+// LookupPoint returns the position of a region or city in the geo table,
+// given either its code or one of its names.
+func LookupPoint(codeOrName string) (Point, bool) {
+	info, ok := GetGeoInfo(strings.ToUpper(codeOrName))
+	if !ok {
+		info, ok = GetGeoInfo(NameToCode(codeOrName))
+	}
+	return Point{info.Latitude, info.Longitude}, ok
+}
+
 // GeoDistance returns the distance between two geolocations in kilometres.
 func GeoDistance(code1, code2 string) float64 {
 	info1, ok1 := GetGeoInfo(code1)
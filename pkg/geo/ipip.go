@@ -1,6 +1,11 @@
 package geo
 
 import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
 	"sync/atomic"
 
 	"github.com/ipipdotnet/ipdb-go"
@@ -9,7 +14,12 @@ import (
 
 type CityInfo = ipdb.CityInfo
 
-var db atomic.Pointer[ipdb.City]
+// IPIP is a Provider backed by an IPIP database.
+type IPIP struct {
+	db atomic.Pointer[ipdb.City]
+}
+
+var _ Provider = (*IPIP)(nil)
 
 // DefaultCityInfo is the placeholder data returned when Lookup is called
 // before a database is loaded.
@@ -21,20 +31,59 @@ var DefaultCityInfo = CityInfo{
 
 var logger = logging.GetLogger("ipip")
 
-// LoadIPDB loads a new IPIP database.
-func LoadIPDB(filename string) error {
+// NewIPIP returns an IPIP provider with no database loaded.
+func NewIPIP() *IPIP {
+	return new(IPIP)
+}
+
+// Load loads a new IPIP database.
+//
+// The new database is validated before replacing the current one.
+// On error, the current database is kept.
+func (i *IPIP) Load(filename string) error {
 	newdb, err := ipdb.NewCity(filename)
+	if err == nil {
+		err = validateIPDB(newdb)
+	}
 	if err != nil {
+		err = fmt.Errorf("IPIP: load %s: %w", filename, err)
+		logger.Errorf("%v, keeping the current database\n", err)
 		return err
 	}
-	db.Store(newdb)
+	i.db.Store(newdb)
+	logger.Infof("IPIP: loaded %s, built at %s\n", filename, newdb.BuildTime())
+	return nil
+}
+
+// validateIPDB checks that a database has the fields we use and answers lookups.
+func validateIPDB(db *ipdb.City) error {
+	if !slices.Contains(db.Languages(), "CN") {
+		return fmt.Errorf("language CN not supported")
+	}
+	for _, field := range []string{"country_name", "region_name"} {
+		if !slices.Contains(db.Fields(), field) {
+			return fmt.Errorf("field %s missing", field)
+		}
+	}
+	if !db.IsIPv4() && !db.IsIPv6() {
+		return fmt.Errorf("neither IPv4 nor IPv6 supported")
+	}
+	probes := map[string]bool{"114.114.114.114": db.IsIPv4(), "2001:da8::1": db.IsIPv6()}
+	for ip, supported := range probes {
+		if !supported {
+			continue
+		}
+		if _, err := db.FindInfo(ip, "CN"); err != nil {
+			return fmt.Errorf("lookup %s: %w", ip, err)
+		}
+	}
 	return nil
 }
 
 // Lookup returns the city information of an IP address.
 // If no database is loaded, it returns a copy of the placeholder data.
-func Lookup(ip string) (*CityInfo, error) {
-	p := db.Load()
+func (i *IPIP) Lookup(ip string) (*CityInfo, error) {
+	p := i.db.Load()
 	if p == nil {
 		// No database loaded, return a copy of the placeholder data.
 		ci := DefaultCityInfo
@@ -46,3 +95,32 @@ func Lookup(ip string) (*CityInfo, error) {
 	}
 	return result, err
 }
+
+// Locate implements the Provider interface.
+func (i *IPIP) Locate(ip net.IP) (loc Location, err error) {
+	info, err := i.Lookup(ip.String())
+	if err != nil {
+		return
+	}
+	loc.Country = CountryCode(info)
+	loc.Region = NameToCode(info.RegionName)
+	loc.City = info.CityName
+	if info.Latitude != "" && info.Longitude != "" {
+		lat, err1 := strconv.ParseFloat(info.Latitude, 64)
+		long, err2 := strconv.ParseFloat(info.Longitude, 64)
+		if p, err := NewPoint(lat, long); err1 == nil && err2 == nil && err == nil {
+			loc.Point = &p
+		}
+	}
+	for _, line := range strings.Split(info.Line, "/") {
+		if isp := ISPNameToCode(line); isp != "" {
+			loc.ISP = append(loc.ISP, isp)
+		} else {
+			noteUnknownISP(line)
+		}
+	}
+	if asn, err := ParseASN(info.ASN); err == nil {
+		loc.ASN = asn
+	}
+	return
+}
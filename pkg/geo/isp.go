@@ -0,0 +1,139 @@
+package geo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/goccy/go-yaml"
+)
+
+// An ISPEntry adds an ISP to the catalogue, or adds aliases to a built-in one.
+type ISPEntry struct {
+	Code    string   `json:"code"`
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases"` // other names returned by geo databases
+}
+
+// builtinISPs is the default ISP catalogue.
+var builtinISPs = []ISPEntry{
+	{"CERNET", "教育网", []string{"中国教育网", "中国教育和科研计算机网", "CERNET2", "China Education and Research Network"}},
+	{"CMCC", "移动", []string{"中国移动", "China Mobile", "China Mobile Communications Corporation"}},
+	{"CHINANET", "电信", []string{"中国电信", "China Telecom", "Chinanet"}},
+	{"UNICOM", "联通", []string{"中国联通", "China Unicom", "China Unicom Backbone", "China169"}},
+	{"CSTNET", "科技网", []string{"中国科技网", "China Science and Technology Network"}},
+	{"DRPENG", "鹏博士", []string{"Dr. Peng", "Dr.Peng"}},
+	{"CBNET", "广电网", []string{"广电", "中国广电", "China Broadnet", "China Broadcasting Network"}},
+}
+
+// ispCatalogue maps ISP names and aliases to codes.
+type ispCatalogue struct {
+	codeToName map[string]string
+	nameToCode map[string]string // keys are normalized with nameKey
+}
+
+var currentISPs atomic.Pointer[ispCatalogue]
+
+func init() {
+	c, _ := newISPCatalogue(nil)
+	currentISPs.Store(c)
+}
+
+// newISPCatalogue merges entries over the built-in ISPs.
+func newISPCatalogue(entries []ISPEntry) (*ispCatalogue, error) {
+	c := &ispCatalogue{
+		codeToName: make(map[string]string),
+		nameToCode: make(map[string]string),
+	}
+	var errs []error
+	for i, e := range append(builtinISPs[:len(builtinISPs):len(builtinISPs)], entries...) {
+		code := strings.ToUpper(strings.TrimSpace(e.Code))
+		if code == "" {
+			errs = append(errs, fmt.Errorf("entry %d: missing code", i+1-len(builtinISPs)))
+			continue
+		}
+		if e.Name != "" || c.codeToName[code] == "" {
+			c.codeToName[code] = e.Name
+		}
+		for _, name := range append([]string{code, e.Name}, e.Aliases...) {
+			if key := nameKey(name); key != "" {
+				c.nameToCode[key] = code
+			}
+		}
+	}
+	return c, errors.Join(errs...)
+}
+
+// LoadISPCatalogue merges a YAML list of ISPEntry over the built-in ISPs,
+// replacing any previously loaded catalogue.
+// On error, the current catalogue is kept.
+func LoadISPCatalogue(filename string) error {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var entries []ISPEntry
+	if err := yaml.Unmarshal(content, &entries); err != nil {
+		return fmt.Errorf("LoadISPCatalogue %s: %w", filename, err)
+	}
+	c, err := newISPCatalogue(entries)
+	if err != nil {
+		return fmt.Errorf("LoadISPCatalogue %s: %w", filename, err)
+	}
+	currentISPs.Store(c)
+	logger.Infof("ISP catalogue: loaded %d entries from %s\n", len(entries), filename)
+	return nil
+}
+
+// ISPNameToCode looks up the code of a given ISP name, alias or code, ignoring case.
+// If the name is not found, an empty string is returned.
+func ISPNameToCode(name string) string {
+	return currentISPs.Load().nameToCode[nameKey(name)]
+}
+
+// IsISPCode reports if code is an ISP code in the catalogue.
+func IsISPCode(code string) bool {
+	_, ok := currentISPs.Load().codeToName[code]
+	return ok
+}
+
+// unknownISPs counts names returned by geo databases that are not in the catalogue.
+var unknownISPs = struct {
+	sync.Mutex
+	counts map[string]int
+}{counts: make(map[string]int)}
+
+// noteUnknownISP counts an unknown ISP name.
+// The count is logged the 1st, 10th, 100th... time a name is seen.
+func noteUnknownISP(name string) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return
+	}
+	unknownISPs.Lock()
+	unknownISPs.counts[name]++
+	count := unknownISPs.counts[name]
+	unknownISPs.Unlock()
+
+	n := count
+	for n%10 == 0 {
+		n /= 10
+	}
+	if n == 1 {
+		logger.Warningf("Unknown ISP %q seen %d times\n", name, count)
+	}
+}
+
+// UnknownISPs returns how many times each unknown ISP name has been seen.
+func UnknownISPs() map[string]int {
+	unknownISPs.Lock()
+	defer unknownISPs.Unlock()
+	counts := make(map[string]int, len(unknownISPs.counts))
+	for name, n := range unknownISPs.counts {
+		counts[name] = n
+	}
+	return counts
+}
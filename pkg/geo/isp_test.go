@@ -0,0 +1,56 @@
+package geo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestISPNameToCode(t *testing.T) {
+	as := assert.New(t)
+	as.Equal("CHINANET", ISPNameToCode("电信"))
+	as.Equal("CHINANET", ISPNameToCode("中国电信"))
+	as.Equal("CHINANET", ISPNameToCode("china telecom"))
+	as.Equal("CERNET", ISPNameToCode("CERNET"))
+	as.Equal("", ISPNameToCode("长城宽带"))
+	as.True(IsISPCode("CBNET"))
+	as.False(IsISPCode("电信"))
+}
+
+func TestLoadISPCatalogue(t *testing.T) {
+	as := assert.New(t)
+	t.Cleanup(func() {
+		c, _ := newISPCatalogue(nil)
+		currentISPs.Store(c)
+	})
+
+	path := filepath.Join(t.TempDir(), "isps.yaml")
+	as.Nil(os.WriteFile(path, []byte(`
+- code: GWBN
+  name: 长城宽带
+  aliases: [Great Wall Broadband Network]
+- code: chinanet
+  aliases: [CN2]
+`), 0644))
+	as.Nil(LoadISPCatalogue(path))
+	as.Equal("GWBN", ISPNameToCode("长城宽带"))
+	as.Equal("GWBN", ISPNameToCode("great wall broadband network"))
+	as.Equal("CHINANET", ISPNameToCode("CN2"))
+	as.Equal("CHINANET", ISPNameToCode("电信"))
+
+	as.Nil(os.WriteFile(path, []byte("- name: no code\n"), 0644))
+	as.NotNil(LoadISPCatalogue(path))
+	as.True(IsISPCode("GWBN"), "a bad catalogue should keep the current one")
+}
+
+func TestUnknownISPs(t *testing.T) {
+	as := assert.New(t)
+	for i := 0; i < 12; i++ {
+		noteUnknownISP("Example Carrier")
+	}
+	noteUnknownISP(" ")
+	as.Equal(12, UnknownISPs()["Example Carrier"])
+	as.NotContains(UnknownISPs(), "")
+}
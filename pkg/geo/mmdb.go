@@ -0,0 +1,135 @@
+package geo
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// MMDB is a Provider backed by a MaxMind DB file,
+// e.g. GeoLite2-City, GeoIP2-ISP or DB-IP.
+type MMDB struct {
+	db atomic.Pointer[maxminddb.Reader]
+}
+
+var _ Provider = (*MMDB)(nil)
+
+// mmdbRecord holds the fields we use from the common MaxMind DB schemas.
+type mmdbRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+
+	// GeoIP2-ISP and DB-IP ISP
+	ISP          string `maxminddb:"isp"`
+	Organization string `maxminddb:"organization"`
+	// GeoLite2-ASN, GeoIP2-ISP and DB-IP ASN
+	ASN   uint32 `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// NewMMDB returns an MMDB provider with no database loaded.
+func NewMMDB() *MMDB {
+	return new(MMDB)
+}
+
+// Load loads a new MaxMind DB file.
+//
+// The file is read into memory instead of mmap'ed,
+// so that the old database can be dropped safely while in use.
+// The new database is verified before replacing the current one.
+// On error, the current database is kept.
+func (m *MMDB) Load(filename string) error {
+	content, err := os.ReadFile(filename)
+	var newdb *maxminddb.Reader
+	if err == nil {
+		newdb, err = maxminddb.FromBytes(content)
+	}
+	if err == nil {
+		err = newdb.Verify()
+	}
+	if err != nil {
+		err = fmt.Errorf("MMDB: load %s: %w", filename, err)
+		logger.Errorf("%v, keeping the current database\n", err)
+		return err
+	}
+	m.db.Store(newdb)
+	logger.Infof("MMDB: loaded %s (%s), built at %s\n", filename, newdb.Metadata.DatabaseType,
+		time.Unix(int64(newdb.Metadata.BuildEpoch), 0).UTC())
+	return nil
+}
+
+// Locate implements the Provider interface.
+// If no database is loaded, it returns a copy of DefaultLocation.
+func (m *MMDB) Locate(ip net.IP) (loc Location, err error) {
+	db := m.db.Load()
+	if db == nil {
+		loc = DefaultLocation
+		loc.ISP = append([]string(nil), DefaultLocation.ISP...)
+		return loc, nil
+	}
+	var record mmdbRecord
+	if err = db.Lookup(ip, &record); err != nil {
+		return
+	}
+	return record.location(), nil
+}
+
+// regionCountries are the countries and territories that are regions in the geo table.
+// Other country codes may coincide with province codes, e.g. SD for Sudan and Shandong.
+var regionCountries = map[string]bool{"HK": true, "MO": true, "TW": true}
+
+// location converts a record to a Location.
+func (record *mmdbRecord) location() (loc Location) {
+	loc.Country = record.Country.ISOCode
+	if len(record.Subdivisions) > 0 && loc.Country == "CN" {
+		sub := record.Subdivisions[0]
+		if _, ok := GetGeoInfo(sub.ISOCode); ok {
+			loc.Region = sub.ISOCode
+		} else if code := NameToCode(sub.Names["zh-CN"]); code != "" {
+			loc.Region = code
+		}
+	}
+	if regionCountries[loc.Country] && loc.Region == "" {
+		loc.Region = loc.Country
+	}
+
+	loc.City = record.City.Names["zh-CN"]
+	if loc.City == "" {
+		loc.City = record.City.Names["en"]
+	}
+	if lat, long := record.Location.Latitude, record.Location.Longitude; lat != nil && long != nil {
+		if p, err := NewPoint(*lat, *long); err == nil {
+			loc.Point = &p
+		}
+	}
+
+	unknown := ""
+	for _, name := range []string{record.ISP, record.Organization, record.ASOrg} {
+		if isp := ISPNameToCode(name); isp != "" {
+			loc.ISP = append(loc.ISP, isp)
+			unknown = ""
+			break
+		} else if unknown == "" {
+			unknown = name
+		}
+	}
+	noteUnknownISP(unknown)
+	loc.ASN = record.ASN
+	return
+}
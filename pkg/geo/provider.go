@@ -0,0 +1,62 @@
+package geo
+
+import (
+	"fmt"
+	"net"
+)
+
+// Location is the geolocation of an IP address, as used for scoring.
+type Location struct {
+	Country string   // ISO 3166-1 alpha-2
+	Region  string   // region code, e.g. "BJ"
+	City    string   // city name as returned by the database
+	Point   *Point   // coordinates from the database, if any
+	ISP     []string // ISP codes, e.g. "CERNET"
+	ASN     uint32   // 0 if unknown
+}
+
+// Position returns the finest known position of the location:
+// the coordinates from the database, the city or the region in the geo table.
+func (loc Location) Position() (Point, bool) {
+	if loc.Point != nil {
+		return *loc.Point, true
+	}
+	if loc.City != "" {
+		if p, ok := LookupPoint(loc.City); ok {
+			return p, true
+		}
+	}
+	if loc.Region != "" {
+		return LookupPoint(loc.Region)
+	}
+	return Point{}, false
+}
+
+// DefaultLocation is the placeholder returned by providers with no database loaded.
+// It matches DefaultCityInfo.
+var DefaultLocation = Location{
+	Country: "CN",
+	Region:  "BJ",
+	ISP:     []string{"CERNET"},
+}
+
+// A Provider looks up the Location of IP addresses from a database file.
+type Provider interface {
+	// Load replaces the database with the content of a file.
+	Load(filename string) error
+	// Locate returns the Location of an IP address.
+	Locate(ip net.IP) (Location, error)
+}
+
+// NewProvider returns an empty Provider of the given kind,
+// either "ipip" (the default) or "mmdb".
+func NewProvider(kind string) (Provider, error) {
+	switch kind {
+	case "", "ipip":
+		return NewIPIP(), nil
+	case "mmdb":
+		return NewMMDB(), nil
+	default:
+		return nil, fmt.Errorf("unknown geo provider %q", kind)
+	}
+}
@@ -0,0 +1,85 @@
+package geo
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProviderPlaceholder(t *testing.T) {
+	as := assert.New(t)
+	for _, kind := range []string{"", "ipip", "mmdb"} {
+		p, err := NewProvider(kind)
+		as.Nil(err)
+		loc, err := p.Locate(net.ParseIP("192.0.2.1"))
+		as.Nil(err)
+		as.Equal(DefaultLocation, loc, "provider %q", kind)
+	}
+	_, err := NewProvider("geoip")
+	as.NotNil(err)
+}
+
+func TestProviderLoadInvalid(t *testing.T) {
+	as := assert.New(t)
+	path := filepath.Join(t.TempDir(), "garbage")
+	as.Nil(os.WriteFile(path, []byte("not a database"), 0644))
+	as.NotNil(NewIPIP().Load(path))
+	as.NotNil(NewMMDB().Load(path))
+}
+
+func TestLocationPosition(t *testing.T) {
+	as := assert.New(t)
+	bj, ok := LookupPoint("BJ")
+	as.True(ok)
+
+	p, ok := DefaultLocation.Position()
+	as.True(ok)
+	as.Equal(bj, p)
+
+	loc := Location{Region: "XJ", City: "北京"}
+	p, _ = loc.Position()
+	as.Equal(bj, p, "city should take precedence over region")
+
+	loc.Point = &Point{39.47, 75.99}
+	p, _ = loc.Position()
+	as.Equal(*loc.Point, p)
+
+	_, ok = Location{Region: "XX"}.Position()
+	as.False(ok)
+}
+
+func TestParsePoint(t *testing.T) {
+	as := assert.New(t)
+	p, err := ParsePoint("39.9, 116.4")
+	as.Nil(err)
+	as.Equal(Point{39.9, 116.4}, p)
+	for _, s := range []string{"39.9", "a,b", "91,0", "0,181"} {
+		_, err := ParsePoint(s)
+		as.NotNil(err, s)
+	}
+}
+
+func TestMMDBRecordRegion(t *testing.T) {
+	as := assert.New(t)
+	record := func(country, subdivision string) *mmdbRecord {
+		r := new(mmdbRecord)
+		r.Country.ISOCode = country
+		if subdivision != "" {
+			r.Subdivisions = append(r.Subdivisions, struct {
+				ISOCode string            `maxminddb:"iso_code"`
+				Names   map[string]string `maxminddb:"names"`
+			}{ISOCode: subdivision})
+		}
+		return r
+	}
+
+	as.Equal("SD", record("CN", "SD").location().Region)
+	as.Equal("HK", record("HK", "").location().Region)
+	// Sudan (SD) and Tajikistan (TJ) are not Shandong and Tianjin
+	as.Equal("", record("SD", "KH").location().Region)
+	as.Equal("", record("SD", "").location().Region)
+	as.Equal("", record("TJ", "").location().Region)
+}
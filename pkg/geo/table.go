@@ -0,0 +1,171 @@
+package geo
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/goccy/go-yaml"
+)
+
+// A TableEntry adds a region to the geo table, or amends a built-in one.
+//
+// Coordinates are required for new regions and optional for existing ones.
+type TableEntry struct {
+	Code      string   `json:"code"`
+	Name      string   `json:"name"`
+	Aliases   []string `json:"aliases"` // other names, e.g. in English or pinyin
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+}
+
+// geoTable is a set of regions with their names and coordinates.
+type geoTable struct {
+	codeToInfo map[string]GeoInfo
+	nameToCode map[string]string // keys are normalized with nameKey
+}
+
+var currentTable atomic.Pointer[geoTable]
+
+func init() {
+	t, _ := newGeoTable(nil)
+	currentTable.Store(t)
+}
+
+// nameKey normalizes a region name for lookup, ignoring case and surrounding spaces.
+func nameKey(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// newGeoTable merges entries over the built-in regions.
+func newGeoTable(entries []TableEntry) (*geoTable, error) {
+	t := &geoTable{
+		codeToInfo: make(map[string]GeoInfo, len(codeToInfo)+len(entries)),
+		nameToCode: make(map[string]string, len(codeToInfo)+len(entries)),
+	}
+	for code, info := range codeToInfo {
+		t.codeToInfo[code] = info
+		t.nameToCode[nameKey(info.Name)] = code
+	}
+
+	var errs []error
+	for i, e := range entries {
+		code := strings.ToUpper(strings.TrimSpace(e.Code))
+		if code == "" {
+			errs = append(errs, fmt.Errorf("entry %d: missing code", i+1))
+			continue
+		}
+		info, exists := t.codeToInfo[code]
+		switch {
+		case (e.Latitude == nil) != (e.Longitude == nil):
+			errs = append(errs, fmt.Errorf("entry %d (%s): latitude and longitude must be given together", i+1, code))
+			continue
+		case e.Latitude == nil && !exists:
+			errs = append(errs, fmt.Errorf("entry %d (%s): coordinates required for a new region", i+1, code))
+			continue
+		case e.Latitude != nil && (math.Abs(*e.Latitude) > 90 || math.Abs(*e.Longitude) > 180):
+			errs = append(errs, fmt.Errorf("entry %d (%s): coordinates out of range", i+1, code))
+			continue
+		}
+		if e.Latitude != nil {
+			info.Latitude, info.Longitude = *e.Latitude, *e.Longitude
+		}
+		if e.Name != "" {
+			info.Name = e.Name
+		}
+		t.codeToInfo[code] = info
+		for _, name := range append([]string{info.Name}, e.Aliases...) {
+			if key := nameKey(name); key != "" {
+				t.nameToCode[key] = code
+			}
+		}
+	}
+	return t, errors.Join(errs...)
+}
+
+// readGeoTableYAML reads a YAML (or JSON) list of TableEntry.
+func readGeoTableYAML(r io.Reader) (entries []TableEntry, err error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.Unmarshal(content, &entries)
+	return
+}
+
+// readGeoTableCSV reads a CSV table with the columns
+// code, name, latitude, longitude and aliases (separated by "|").
+// Trailing columns may be omitted, and a header line starting with "code" is skipped.
+func readGeoTableCSV(r io.Reader) (entries []TableEntry, err error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.Comment = '#'
+	cr.TrimLeadingSpace = true
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	for i, record := range records {
+		if i == 0 && strings.EqualFold(record[0], "code") {
+			continue
+		}
+		field := func(n int) string {
+			if n < len(record) {
+				return strings.TrimSpace(record[n])
+			}
+			return ""
+		}
+		e := TableEntry{Code: field(0), Name: field(1)}
+		for n, coord := range []**float64{&e.Latitude, &e.Longitude} {
+			if s := field(2 + n); s != "" {
+				v, err := strconv.ParseFloat(s, 64)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", i+1, err)
+				}
+				*coord = &v
+			}
+		}
+		if aliases := field(4); aliases != "" {
+			e.Aliases = strings.Split(aliases, "|")
+		}
+		entries = append(entries, e)
+	}
+	return
+}
+
+// LoadGeoTable merges a table of regions over the built-in ones,
+// replacing any previously loaded table.
+//
+// Files ending with ".csv" are read as CSV, others as YAML.
+// On error, the current table is kept.
+func LoadGeoTable(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var entries []TableEntry
+	if strings.EqualFold(filepath.Ext(filename), ".csv") {
+		entries, err = readGeoTableCSV(f)
+	} else {
+		entries, err = readGeoTableYAML(f)
+	}
+	if err != nil {
+		return fmt.Errorf("LoadGeoTable %s: %w", filename, err)
+	}
+	t, err := newGeoTable(entries)
+	if err != nil {
+		return fmt.Errorf("LoadGeoTable %s: %w", filename, err)
+	}
+	currentTable.Store(t)
+	logger.Infof("Geo table: loaded %d entries from %s\n", len(entries), filename)
+	return nil
+}
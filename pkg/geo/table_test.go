@@ -0,0 +1,82 @@
+package geo
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testGeoTableYAML = `
+- code: jp
+  name: 日本
+  aliases: [Japan, Nihon]
+  latitude: 35.6762
+  longitude: 139.6503
+- code: BJ
+  aliases: [Beijing, Peking]
+`
+
+const testGeoTableCSV = `code,name,latitude,longitude,aliases
+# comment
+JP,日本,35.6762,139.6503,Japan|Nihon
+BJ,,,,Beijing|Peking
+`
+
+func TestReadGeoTable(t *testing.T) {
+	as := assert.New(t)
+	fromYAML, err := readGeoTableYAML(strings.NewReader(testGeoTableYAML))
+	as.NoError(err)
+	fromCSV, err := readGeoTableCSV(strings.NewReader(testGeoTableCSV))
+	as.NoError(err)
+
+	for _, entries := range [][]TableEntry{fromYAML, fromCSV} {
+		table, err := newGeoTable(entries)
+		if !as.NoError(err) {
+			continue
+		}
+		as.Equal("JP", table.nameToCode["japan"])
+		as.Equal("JP", table.nameToCode["日本"])
+		as.InDelta(35.6762, table.codeToInfo["JP"].Latitude, 1e-6)
+		as.Equal("BJ", table.nameToCode["peking"])
+		as.Equal("BJ", table.nameToCode["北京"])
+		as.Equal(codeToInfo["BJ"], table.codeToInfo["BJ"])
+	}
+}
+
+func TestGeoTableInvalid(t *testing.T) {
+	as := assert.New(t)
+	lat, long := 35.0, 200.0
+	_, err := newGeoTable([]TableEntry{
+		{Name: "no code"},
+		{Code: "XX"},
+		{Code: "YY", Latitude: &lat},
+		{Code: "ZZ", Latitude: &lat, Longitude: &long},
+	})
+	as.ErrorContains(err, "missing code")
+	as.ErrorContains(err, "XX")
+	as.ErrorContains(err, "YY")
+	as.ErrorContains(err, "ZZ")
+}
+
+func TestLoadGeoTable(t *testing.T) {
+	as := assert.New(t)
+	t.Cleanup(func() {
+		table, _ := newGeoTable(nil)
+		currentTable.Store(table)
+	})
+
+	dir := t.TempDir()
+	good := filepath.Join(dir, "regions.csv")
+	as.NoError(os.WriteFile(good, []byte(testGeoTableCSV), 0o644))
+	as.NoError(LoadGeoTable(good))
+	as.Equal("JP", NameToCode("JAPAN"))
+	as.Less(GeoDistance("BJ", "JP"), 2200.0)
+
+	bad := filepath.Join(dir, "bad.yaml")
+	as.NoError(os.WriteFile(bad, []byte("- code: XX\n"), 0o644))
+	as.Error(LoadGeoTable(bad))
+	as.Equal("JP", NameToCode("Japan"), "a bad table should keep the current one")
+}
@@ -0,0 +1,141 @@
+package influxdb
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by BreakerSource while the circuit is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// BreakerSource is a circuit breaker around a MirrorStatusSource.
+//
+// Each query is given at most timeout. After threshold consecutive failures
+// the circuit opens and queries fail fast with ErrCircuitOpen.
+// Once cooldown has passed, a single trial query is let through (half-open):
+// success closes the circuit, failure keeps it open for another cooldown.
+type BreakerSource struct {
+	src       MirrorStatusSource
+	timeout   time.Duration
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time // zero when closed
+	trial    bool      // a half-open trial query is in flight
+}
+
+var (
+	_ MirrorStatusSource = (*BreakerSource)(nil)
+	_ BatchQuerier       = (*BreakerSource)(nil)
+)
+
+// NewBreakerSource wraps src with a per-query timeout and a circuit breaker.
+//
+// A zero timeout leaves the context untouched,
+// and a zero threshold disables the circuit breaker.
+func NewBreakerSource(src MirrorStatusSource, timeout time.Duration, threshold int, cooldown time.Duration) *BreakerSource {
+	return &BreakerSource{
+		src:       src,
+		timeout:   timeout,
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// allow reports whether a query may be issued now.
+func (b *BreakerSource) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openedAt.IsZero() {
+		return true
+	}
+	if b.trial || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// record updates the breaker state with the outcome of a query.
+func (b *BreakerSource) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if !failed {
+		if !b.openedAt.IsZero() {
+			statusLogger.Infof("Circuit breaker closed\n")
+		}
+		b.failures = 0
+		b.openedAt = time.Time{}
+		return
+	}
+	b.failures++
+	if b.threshold > 0 && b.failures >= b.threshold {
+		if b.openedAt.IsZero() {
+			statusLogger.Warningf("Circuit breaker opened after %d consecutive failures\n", b.failures)
+		}
+		b.openedAt = time.Now()
+	}
+}
+
+// release gives up a half-open trial without recording an outcome.
+func (b *BreakerSource) release() {
+	b.mu.Lock()
+	b.trial = false
+	b.mu.Unlock()
+}
+
+// Open reports whether the circuit is currently open.
+func (b *BreakerSource) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openedAt.IsZero()
+}
+
+// guard runs query with the timeout if the breaker allows it,
+// and records whether it failed.
+func (b *BreakerSource) guard(ctx context.Context, query func(ctx context.Context) (failed bool)) error {
+	if !b.allow() {
+		return ErrCircuitOpen
+	}
+	queryCtx := ctx
+	if b.timeout > 0 {
+		var cancel context.CancelFunc
+		queryCtx, cancel = context.WithTimeout(ctx, b.timeout)
+		defer cancel()
+	}
+	failed := query(queryCtx)
+	if failed && ctx.Err() != nil {
+		// a request cancelled by the client says nothing about the source
+		b.release()
+	} else {
+		b.record(failed)
+	}
+	return nil
+}
+
+// Query implements the MirrorStatusSource interface.
+func (b *BreakerSource) Query(ctx context.Context, cname string) (res Result, err error) {
+	if openErr := b.guard(ctx, func(ctx context.Context) bool {
+		res, err = b.src.Query(ctx, cname)
+		return res == nil
+	}); openErr != nil {
+		return nil, openErr
+	}
+	return
+}
+
+// QueryMany implements the BatchQuerier interface.
+func (b *BreakerSource) QueryMany(ctx context.Context, cnames []string) (m map[string]Result, err error) {
+	if openErr := b.guard(ctx, func(ctx context.Context) bool {
+		m, err = QueryMany(ctx, b.src, cnames)
+		return m == nil
+	}); openErr != nil {
+		return nil, openErr
+	}
+	return
+}
@@ -0,0 +1,58 @@
+package influxdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreakerSource(t *testing.T) {
+	as := assert.New(t)
+	ctx := context.Background()
+	src := &failingSource{MirrorStatusSource: NewStaticSource(map[string]Result{
+		"debian": {{Mirror: "tuna"}},
+	})}
+	b := NewBreakerSource(src, time.Second, 2, time.Hour)
+
+	src.fail = true
+	_, err := b.Query(ctx, "debian")
+	as.ErrorIs(err, errFailing)
+	as.False(b.Open())
+	_, err = b.Query(ctx, "debian")
+	as.ErrorIs(err, errFailing)
+	as.True(b.Open())
+
+	// open: fail fast without touching the source
+	src.fail = false
+	res, err := b.Query(ctx, "debian")
+	as.Nil(res)
+	as.ErrorIs(err, ErrCircuitOpen)
+
+	// half-open after cooldown: a successful trial closes the circuit
+	b.cooldown = 0
+	res, err = b.Query(ctx, "debian")
+	as.Nil(err)
+	as.Len(res, 1)
+	as.False(b.Open())
+}
+
+func TestStaleBreakerSource(t *testing.T) {
+	as := assert.New(t)
+	ctx := context.Background()
+	src := &failingSource{MirrorStatusSource: NewStaticSource(map[string]Result{
+		"debian": {{Mirror: "tuna"}},
+	})}
+	s := NewStaleSource(NewBreakerSource(src, 0, 1, time.Hour), time.Hour)
+
+	_, err := s.Query(ctx, "debian")
+	as.Nil(err)
+	src.fail = true
+	_, err = s.Query(ctx, "debian")
+	as.ErrorIs(err, errFailing)
+
+	res, err := s.Query(ctx, "debian")
+	as.ErrorIs(err, ErrCircuitOpen)
+	as.Len(res, 1)
+}
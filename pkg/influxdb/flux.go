@@ -0,0 +1,119 @@
+package influxdb
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// fluxString encodes s as a Flux string literal, including the surrounding quotes.
+//
+// Besides quotes and backslashes, "${" is escaped to prevent string interpolation,
+// and control characters are written as escape sequences.
+// See https://docs.influxdata.com/flux/v0/spec/lexical-elements/#string-literals
+func fluxString(s string) string {
+	var b strings.Builder
+	b.Grow(len(s) + 2)
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '$' && i+1 < len(s) && s[i+1] == '{':
+			b.WriteString(`\$`)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// queryShape holds everything needed to build a status query.
+type queryShape struct {
+	bucket      string
+	measurement string
+	lookback    time.Duration
+	fields      Fields
+}
+
+// newQueryShape fills in defaults for empty values in config.
+func newQueryShape(config Config) queryShape {
+	q := queryShape{
+		bucket:      config.Bucket,
+		measurement: config.Measurement,
+		lookback:    time.Duration(config.Lookback) * time.Second,
+		fields:      config.Fields,
+	}
+	if q.measurement == "" {
+		q.measurement = DefaultMeasurement
+	}
+	if q.lookback <= 0 {
+		q.lookback = DefaultLookback * time.Second
+	}
+	for _, f := range []struct {
+		field *string
+		def   string
+	}{
+		{&q.fields.Value, DefaultFields.Value},
+		{&q.fields.Mirror, DefaultFields.Mirror},
+		{&q.fields.Name, DefaultFields.Name},
+		{&q.fields.Path, DefaultFields.Path},
+		{&q.fields.Disable, DefaultFields.Disable},
+	} {
+		if *f.field == "" {
+			*f.field = f.def
+		}
+	}
+	return q
+}
+
+// column returns a Flux member expression for a column of r.
+func column(name string) string {
+	return "r[" + fluxString(name) + "]"
+}
+
+// build builds the Flux query for the latest status of each mirror serving cnames.
+//
+// If cnames is empty, all cnames are queried.
+// The cname of each record is kept in the "name" column.
+func (q queryShape) build(cnames []string) string {
+	filter := "r._measurement == " + fluxString(q.measurement)
+	switch len(cnames) {
+	case 0:
+	case 1:
+		filter += " and " + column(q.fields.Name) + " == " + fluxString(cnames[0])
+	default:
+		set := make([]string, len(cnames))
+		for i, cname := range cnames {
+			set[i] = fluxString(cname)
+		}
+		filter += " and contains(value: " + column(q.fields.Name) +
+			", set: [" + strings.Join(set, ", ") + "])"
+	}
+	return fmt.Sprintf(`from(bucket: %s)
+        |> range(start: -%ds)
+        |> filter(fn: (r) => %s)
+		|> pivot(rowKey:["_time"], columnKey: ["_field"], valueColumn: "_value")
+		|> map(fn: (r) => ({
+			_value: %s,
+			mirror: %s,
+			name: %s,
+			_time: r._time,
+			path: %s,
+			disable: %s
+		   }))
+        |> tail(n: 1)`, fluxString(q.bucket), int64(q.lookback/time.Second), filter,
+		column(q.fields.Value), column(q.fields.Mirror), column(q.fields.Name),
+		column(q.fields.Path), column(q.fields.Disable))
+}
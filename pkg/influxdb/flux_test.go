@@ -0,0 +1,116 @@
+package influxdb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// unquoteFlux decodes a literal produced by fluxString,
+// failing if the literal terminates early.
+func unquoteFlux(t *testing.T, lit string) string {
+	t.Helper()
+	if len(lit) < 2 || lit[0] != '"' || lit[len(lit)-1] != '"' {
+		t.Fatalf("not a string literal: %s", lit)
+	}
+	var b strings.Builder
+	body := lit[1 : len(lit)-1]
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case c == '"':
+			t.Fatalf("unescaped quote at %d in %s", i, lit)
+		case c == '$' && i+1 < len(body) && body[i+1] == '{':
+			t.Fatalf("unescaped interpolation at %d in %s", i, lit)
+		case c < 0x20:
+			t.Fatalf("raw control character at %d in %s", i, lit)
+		case c != '\\':
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch body[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'x':
+			var v byte
+			for _, h := range body[i+1 : i+3] {
+				v <<= 4
+				if h >= 'a' {
+					v += byte(h-'a') + 10
+				} else {
+					v += byte(h - '0')
+				}
+			}
+			b.WriteByte(v)
+			i += 2
+		default:
+			b.WriteByte(body[i])
+		}
+	}
+	return b.String()
+}
+
+var hostileCNames = []string{
+	`debian`,
+	`a"b`,
+	`") |> drop(columns: ["_value"]) //`,
+	`\") |> yield() //`,
+	`${r._value}`,
+	"line\nbreak\r\ttab",
+	"nul\x00bell\x07del\x7f",
+	`\`,
+	`$`,
+	`中文"镜像`,
+}
+
+func TestFluxString(t *testing.T) {
+	as := assert.New(t)
+	as.Equal(`"debian"`, fluxString("debian"))
+	as.Equal(`"a\"b"`, fluxString(`a"b`))
+	as.Equal(`"\\"`, fluxString(`\`))
+	as.Equal(`"\${x}"`, fluxString("${x}"))
+	as.Equal(`"$x"`, fluxString("$x"))
+	as.Equal(`"\n\x00"`, fluxString("\n\x00"))
+
+	for _, cname := range hostileCNames {
+		as.Equal(cname, unquoteFlux(t, fluxString(cname)))
+	}
+}
+
+func TestBuildQuery(t *testing.T) {
+	as := assert.New(t)
+	q := newQueryShape(Config{Bucket: "mirrorz"})
+	for _, cname := range hostileCNames {
+		query := q.build([]string{cname})
+		as.Contains(query, `r["name"] == `+fluxString(cname))
+		as.Equal(1, strings.Count(query, "|> filter("))
+		as.Equal(1, strings.Count(query, "|> tail("))
+	}
+	as.NotContains(q.build(nil), `r["name"] ==`)
+	as.Contains(q.build(nil), `r._measurement == "repo"`)
+	as.Contains(q.build(nil), "range(start: -3600s)")
+	as.Contains(q.build(nil), `path: r["url"]`)
+
+	q = newQueryShape(Config{
+		Bucket:      `evil"bucket`,
+		Lookback:    600,
+		Measurement: "status",
+		Fields:      Fields{Path: `p"ath`},
+	})
+	query := q.build([]string{"debian"})
+	as.Contains(query, `from(bucket: "evil\"bucket")`)
+	as.Contains(query, "range(start: -600s)")
+	as.Contains(query, `r._measurement == "status"`)
+	as.Contains(query, `path: r["p\"ath"]`)
+	as.Contains(query, `_value: r["value"]`)
+
+	query = q.build(hostileCNames)
+	as.Equal(1, strings.Count(query, "|> filter("))
+	as.Contains(query, `contains(value: r["name"], set: ["debian", "a\"b", `)
+}
@@ -2,12 +2,12 @@ package influxdb
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api"
-	"github.com/influxdata/influxdb/pkg/escape"
+	"github.com/influxdata/influxdb-client-go/v2/api/query"
 )
 
 type Config struct {
@@ -15,75 +15,186 @@ type Config struct {
 	Token  string `json:"token"`
 	Org    string `json:"org"`
 	Bucket string `json:"bucket"`
+
+	// query shape, empty values take the defaults
+	Lookback    int    `json:"lookback"`    // seconds, defaults to DefaultLookback
+	Measurement string `json:"measurement"` // defaults to DefaultMeasurement
+	Fields      Fields `json:"fields"`
+}
+
+// Fields maps the columns of a status Item to columns of the measurement.
+type Fields struct {
+	Value   string `json:"value"`
+	Mirror  string `json:"mirror"`
+	Name    string `json:"name"` // cname
+	Path    string `json:"path"`
+	Disable string `json:"disable"`
+}
+
+const (
+	DefaultLookback    = 3600
+	DefaultMeasurement = "repo"
+)
+
+// DefaultFields is the column mapping used by mirrorz-monitor.
+var DefaultFields = Fields{
+	Value:   "value",
+	Mirror:  "mirror",
+	Name:    "name",
+	Path:    "url",
+	Disable: "disable",
 }
 
 type Source struct {
-	bucket string
+	shape queryShape
 
 	client   influxdb2.Client
 	queryAPI api.QueryAPI
 }
 
 func NewSource(url, token, org, bucket string) *Source {
-	client := influxdb2.NewClient(url, token)
-	queryAPI := client.QueryAPI(org)
+	return NewSourceFromConfig(Config{
+		URL:    url,
+		Token:  token,
+		Org:    org,
+		Bucket: bucket,
+	})
+}
+
+func NewSourceFromConfig(config Config) *Source {
+	client := influxdb2.NewClient(config.URL, config.Token)
+	queryAPI := client.QueryAPI(config.Org)
 	return &Source{
-		bucket:   bucket,
+		shape:    newQueryShape(config),
 		client:   client,
 		queryAPI: queryAPI,
 	}
 }
 
-func NewSourceFromConfig(config Config) *Source {
-	return NewSource(config.URL, config.Token, config.Org, config.Bucket)
-}
-
 func (s *Source) Close() {
 	s.client.Close()
 }
 
 type Item struct {
-	Value  int
-	Mirror string
-	Time   time.Time
-	Path   string
+	Value  int       `json:"value"`
+	Mirror string    `json:"mirror"`
+	Time   time.Time `json:"time"`
+	Path   string    `json:"path"`
 }
 
 // Result is the return type of Query.
 type Result = []Item
 
+// MirrorStatusSource provides the freshness of every mirror serving a cname.
+//
+// A nil Result indicates that the query has failed entirely.
+// A non-nil Result with an error may still be used.
+type MirrorStatusSource interface {
+	Query(ctx context.Context, cname string) (Result, error)
+}
+
+// AllQuerier is implemented by sources that can fetch the status of all cnames at once.
+type AllQuerier interface {
+	QueryAll(ctx context.Context) (map[string]Result, error)
+}
+
+// BatchQuerier is implemented by sources that can fetch the status of many cnames in one round-trip.
+//
+// Unless an error is returned, the map has an entry for every requested cname.
+type BatchQuerier interface {
+	QueryMany(ctx context.Context, cnames []string) (map[string]Result, error)
+}
+
+// QueryMany fetches the status of cnames from src,
+// in one round-trip if src is a BatchQuerier, or with one Query per cname otherwise.
+func QueryMany(ctx context.Context, src MirrorStatusSource, cnames []string) (map[string]Result, error) {
+	if b, ok := src.(BatchQuerier); ok {
+		return b.QueryMany(ctx, cnames)
+	}
+	m := make(map[string]Result, len(cnames))
+	var errs []error
+	for _, cname := range cnames {
+		res, err := src.Query(ctx, cname)
+		if res == nil {
+			return nil, err
+		} else if err != nil {
+			errs = append(errs, err)
+		}
+		m[cname] = res
+	}
+	return m, errors.Join(errs...)
+}
+
+var (
+	_ MirrorStatusSource = (*Source)(nil)
+	_ AllQuerier         = (*Source)(nil)
+	_ BatchQuerier       = (*Source)(nil)
+)
+
 func (s *Source) Query(ctx context.Context, cname string) (Result, error) {
-	query := fmt.Sprintf(`from(bucket: "%s")
-        |> range(start: -1h)
-        |> filter(fn: (r) => r._measurement == "repo" and r.name == "%s")
-		|> pivot(rowKey:["_time"], columnKey: ["_field"], valueColumn: "_value")
-		|> map(fn: (r) => ({
-			_value: r.value,
-			mirror: r.mirror,
-			_time: r._time,
-			path: r.url,
-			disable: r.disable
-		   }))
-        |> tail(n: 1)`, s.bucket, escape.String(cname))
-	// SQL INJECTION!!! (use read only token)
+	if cname == "" {
+		return make(Result, 0), nil
+	}
+	m, err := s.query(ctx, s.shape.build([]string{cname}))
+	if m == nil {
+		return nil, err
+	}
+	return append(make(Result, 0), m[cname]...), err
+}
+
+// QueryAll implements the AllQuerier interface.
+//
+// It fetches the latest status of every cname in a single query.
+func (s *Source) QueryAll(ctx context.Context) (map[string]Result, error) {
+	return s.query(ctx, s.shape.build(nil))
+}
+
+// QueryMany implements the BatchQuerier interface.
+func (s *Source) QueryMany(ctx context.Context, cnames []string) (map[string]Result, error) {
+	if len(cnames) == 0 {
+		return make(map[string]Result), nil
+	}
+	m, err := s.query(ctx, s.shape.build(cnames))
+	if m == nil {
+		return nil, err
+	}
+	for _, cname := range cnames {
+		if m[cname] == nil {
+			m[cname] = make(Result, 0)
+		}
+	}
+	return m, err
+}
+
+// query runs a status query and groups the records by cname.
+func (s *Source) query(ctx context.Context, query string) (map[string]Result, error) {
 	res, err := s.queryAPI.Query(ctx, query)
 	if err != nil {
 		return nil, err
 	}
 	defer res.Close()
-	r := make(Result, 0)
+	m := make(map[string]Result)
 	for res.Next() {
 		record := res.Record()
-		disable, _ := record.ValueByKey("disable").(bool)
-		if disable {
-			continue
+		name, _ := record.ValueByKey("name").(string)
+		if item, ok := parseRecord(record); ok && name != "" {
+			m[name] = append(m[name], item)
 		}
-		r = append(r, Item{
-			Value:  int(record.Value().(int64)),
-			Mirror: record.ValueByKey("mirror").(string),
-			Time:   record.Time(),
-			Path:   record.ValueByKey("path").(string),
-		})
 	}
-	return r, res.Err()
+	return m, res.Err()
+}
+
+// parseRecord converts a query record into an Item.
+// Disabled records are rejected.
+func parseRecord(record *query.FluxRecord) (item Item, ok bool) {
+	disable, _ := record.ValueByKey("disable").(bool)
+	if disable {
+		return
+	}
+	return Item{
+		Value:  int(record.Value().(int64)),
+		Mirror: record.ValueByKey("mirror").(string),
+		Time:   record.Time(),
+		Path:   record.ValueByKey("path").(string),
+	}, true
 }
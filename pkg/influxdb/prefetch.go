@@ -0,0 +1,159 @@
+package influxdb
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mirrorz-org/mirrorz-302/pkg/logging"
+)
+
+var statusLogger = logging.GetLogger("status")
+
+// PrefetchableSource is the combination of MirrorStatusSource and AllQuerier.
+type PrefetchableSource interface {
+	MirrorStatusSource
+	AllQuerier
+}
+
+// PrefetchSource keeps the status of all cnames in memory,
+// refreshed periodically with a single QueryAll.
+//
+// Query reads from the in-memory table and only queries the underlying source
+// for cnames not in the table. A table not refreshed for two intervals is not used,
+// so that during an outage queries fail and StaleSource and BreakerSource apply.
+type PrefetchSource struct {
+	src      PrefetchableSource
+	interval time.Duration
+	table    atomic.Pointer[prefetchTable]
+
+	mu   sync.Mutex
+	stop chan struct{}
+}
+
+var (
+	_ MirrorStatusSource = (*PrefetchSource)(nil)
+	_ AllQuerier         = (*PrefetchSource)(nil)
+	_ BatchQuerier       = (*PrefetchSource)(nil)
+)
+
+// prefetchTable is the status of all cnames at the time of a refresh.
+type prefetchTable struct {
+	results map[string]Result
+	time    time.Time
+}
+
+// NewPrefetchSource wraps src with a table refreshed every interval.
+// Call Start to begin refreshing.
+func NewPrefetchSource(src PrefetchableSource, interval time.Duration) *PrefetchSource {
+	return &PrefetchSource{src: src, interval: interval}
+}
+
+// current returns the table if it was refreshed within two intervals,
+// tolerating a single failed refresh, or nil.
+func (p *PrefetchSource) current() map[string]Result {
+	t := p.table.Load()
+	if t == nil || time.Since(t.time) > 2*p.interval {
+		return nil
+	}
+	return t.results
+}
+
+// Query implements the MirrorStatusSource interface.
+func (p *PrefetchSource) Query(ctx context.Context, cname string) (Result, error) {
+	if res, ok := p.current()[cname]; ok {
+		return append(make(Result, 0, len(res)), res...), nil
+	}
+	return p.src.Query(ctx, cname)
+}
+
+// QueryAll implements the AllQuerier interface.
+func (p *PrefetchSource) QueryAll(ctx context.Context) (map[string]Result, error) {
+	if t := p.current(); t != nil {
+		m := make(map[string]Result, len(t))
+		for cname, res := range t {
+			m[cname] = append(Result(nil), res...)
+		}
+		return m, nil
+	}
+	return p.src.QueryAll(ctx)
+}
+
+// QueryMany implements the BatchQuerier interface.
+//
+// Only cnames missing from the table are queried from the underlying source.
+func (p *PrefetchSource) QueryMany(ctx context.Context, cnames []string) (map[string]Result, error) {
+	m := make(map[string]Result, len(cnames))
+	var missing []string
+	t := p.current()
+	for _, cname := range cnames {
+		if res, ok := t[cname]; ok {
+			m[cname] = append(make(Result, 0, len(res)), res...)
+			continue
+		}
+		missing = append(missing, cname)
+	}
+	if len(missing) == 0 {
+		return m, nil
+	}
+	rest, err := QueryMany(ctx, p.src, missing)
+	if rest == nil {
+		return nil, err
+	}
+	for cname, res := range rest {
+		m[cname] = res
+	}
+	return m, err
+}
+
+// Refresh fetches the status of all cnames and swaps in the new table.
+//
+// On error, the previous table is kept until it is two intervals old.
+func (p *PrefetchSource) Refresh(ctx context.Context) error {
+	start := time.Now()
+	m, err := p.src.QueryAll(ctx)
+	if err != nil {
+		return err
+	}
+	p.table.Store(&prefetchTable{results: m, time: start})
+	statusLogger.Debugf("Prefetched %d cnames in %s\n", len(m), time.Since(start))
+	return nil
+}
+
+func (p *PrefetchSource) refresher(ticker *time.Ticker, stop <-chan struct{}) {
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), p.interval)
+		if err := p.Refresh(ctx); err != nil {
+			statusLogger.Errorf("Prefetch failed: %v\n", err)
+		}
+		cancel()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Start refreshes the table immediately and then every interval in the background.
+func (p *PrefetchSource) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop != nil {
+		return
+	}
+	p.stop = make(chan struct{})
+	go p.refresher(time.NewTicker(p.interval), p.stop)
+}
+
+// Stop stops the background refresher. The table is kept.
+func (p *PrefetchSource) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+}
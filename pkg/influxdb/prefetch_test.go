@@ -0,0 +1,91 @@
+package influxdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefetchSource(t *testing.T) {
+	as := assert.New(t)
+	ctx := context.Background()
+	src := NewStaticSource(map[string]Result{
+		"debian": {{Mirror: "tuna", Value: -10}},
+	})
+	p := NewPrefetchSource(src, time.Minute)
+	as.Nil(p.Refresh(ctx))
+
+	// served from the table, not affected by later changes
+	src.Store("debian", Result{{Mirror: "ustc", Value: -20}})
+	res, _ := p.Query(ctx, "debian")
+	as.Equal(Result{{Mirror: "tuna", Value: -10}}, res)
+
+	// unknown cnames fall back to a live query
+	src.Store("ubuntu", Result{{Mirror: "ustc"}})
+	res, _ = p.Query(ctx, "ubuntu")
+	as.Equal(Result{{Mirror: "ustc"}}, res)
+
+	as.Nil(p.Refresh(ctx))
+	res, _ = p.Query(ctx, "debian")
+	as.Equal(Result{{Mirror: "ustc", Value: -20}}, res)
+}
+
+// failingAllSource fails every query when fail is set.
+type failingAllSource struct {
+	*StaticSource
+	fail bool
+}
+
+func (f *failingAllSource) Query(ctx context.Context, cname string) (Result, error) {
+	if f.fail {
+		return nil, errFailing
+	}
+	return f.StaticSource.Query(ctx, cname)
+}
+
+func (f *failingAllSource) QueryAll(ctx context.Context) (map[string]Result, error) {
+	if f.fail {
+		return nil, errFailing
+	}
+	return f.StaticSource.QueryAll(ctx)
+}
+
+func (f *failingAllSource) QueryMany(ctx context.Context, cnames []string) (map[string]Result, error) {
+	if f.fail {
+		return nil, errFailing
+	}
+	return f.StaticSource.QueryMany(ctx, cnames)
+}
+
+func TestPrefetchSourceOutdated(t *testing.T) {
+	as := assert.New(t)
+	ctx := context.Background()
+	src := &failingAllSource{StaticSource: NewStaticSource(map[string]Result{
+		"debian": {{Mirror: "tuna", Value: -10}},
+	})}
+	p := NewPrefetchSource(src, 50*time.Millisecond)
+	s := NewStaleSource(p, time.Hour)
+	as.Nil(p.Refresh(ctx))
+	_, err := s.Query(ctx, "debian")
+	as.Nil(err)
+
+	// a failed refresh keeps the table for a while
+	src.fail = true
+	as.NotNil(p.Refresh(ctx))
+	res, err := p.Query(ctx, "debian")
+	as.Nil(err)
+	as.Len(res, 1)
+
+	// then the failure is seen, and the result is served as stale
+	time.Sleep(120 * time.Millisecond)
+	_, err = p.Query(ctx, "debian")
+	as.ErrorIs(err, errFailing)
+	_, err = p.QueryMany(ctx, []string{"debian"})
+	as.ErrorIs(err, errFailing)
+	res, err = s.Query(ctx, "debian")
+	var staleErr *StaleError
+	as.ErrorAs(err, &staleErr)
+	as.Len(res, 1)
+}
@@ -0,0 +1,123 @@
+package influxdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// SnapshotRecord is a single monitor result in a snapshot file.
+//
+// It carries the same fields as a row of the "repo" measurement.
+type SnapshotRecord struct {
+	Mirror  string    `json:"mirror"`
+	CName   string    `json:"cname"`
+	Value   int       `json:"value"`
+	Path    string    `json:"path"`
+	Disable bool      `json:"disable"`
+	Time    time.Time `json:"time"`
+}
+
+// SnapshotSource is a MirrorStatusSource backed by a local snapshot file.
+//
+// The file is either a JSON array of SnapshotRecords or one SnapshotRecord per line (JSONL).
+// Like Source.Query, only the latest record of each mirror is kept,
+// and disabled records are dropped.
+type SnapshotSource struct {
+	StaticSource
+	path string
+}
+
+var _ MirrorStatusSource = (*SnapshotSource)(nil)
+
+// NewSnapshotSource returns an empty SnapshotSource reading from path.
+// Call Reload to load the file.
+func NewSnapshotSource(path string) *SnapshotSource {
+	return &SnapshotSource{
+		StaticSource: StaticSource{data: make(map[string]Result)},
+		path:         path,
+	}
+}
+
+// Reload reads the snapshot file again.
+//
+// On error, the existing data is kept.
+func (s *SnapshotSource) Reload() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return fmt.Errorf("SnapshotSource.Reload: %w", err)
+	}
+	defer f.Close()
+	records, err := ReadSnapshot(f)
+	if err != nil {
+		return fmt.Errorf("SnapshotSource.Reload: parse %s: %w", s.path, err)
+	}
+	s.Replace(SnapshotResults(records))
+	return nil
+}
+
+// ReadSnapshot parses snapshot records in either JSON array or JSONL format.
+func ReadSnapshot(r io.Reader) (records []SnapshotRecord, err error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	content = bytes.TrimSpace(content)
+	if len(content) > 0 && content[0] == '[' {
+		err = json.Unmarshal(content, &records)
+		return
+	}
+	dec := json.NewDecoder(bytes.NewReader(content))
+	for {
+		var record SnapshotRecord
+		err = dec.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("record %d: %w", len(records)+1, err)
+		}
+		records = append(records, record)
+	}
+}
+
+// SnapshotResults groups snapshot records into a Result for each cname.
+func SnapshotResults(records []SnapshotRecord) map[string]Result {
+	latest := make(map[string]map[string]SnapshotRecord)
+	for _, record := range records {
+		mirrors, ok := latest[record.CName]
+		if !ok {
+			mirrors = make(map[string]SnapshotRecord)
+			latest[record.CName] = mirrors
+		}
+		if old, ok := mirrors[record.Mirror]; ok && old.Time.After(record.Time) {
+			continue
+		}
+		mirrors[record.Mirror] = record
+	}
+
+	data := make(map[string]Result, len(latest))
+	for cname, mirrors := range latest {
+		res := make(Result, 0, len(mirrors))
+		for _, record := range mirrors {
+			if record.Disable {
+				continue
+			}
+			res = append(res, Item{
+				Value:  record.Value,
+				Mirror: record.Mirror,
+				Time:   record.Time,
+				Path:   record.Path,
+			})
+		}
+		sort.Slice(res, func(i, j int) bool {
+			return res[i].Mirror < res[j].Mirror
+		})
+		data[cname] = res
+	}
+	return data
+}
@@ -0,0 +1,58 @@
+package influxdb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSnapshotJSONL = `{"mirror": "tuna", "cname": "debian", "value": -30, "path": "/debian", "time": "2024-01-01T00:00:00Z"}
+{"mirror": "tuna", "cname": "debian", "value": -10, "path": "/debian", "time": "2024-01-01T00:10:00Z"}
+{"mirror": "ustc", "cname": "debian", "value": -20, "path": "/debian", "disable": true, "time": "2024-01-01T00:10:00Z"}
+{"mirror": "ustc", "cname": "ubuntu", "value": 0, "path": "/ubuntu", "time": "2024-01-01T00:10:00Z"}
+`
+
+func TestReadSnapshot(t *testing.T) {
+	as := assert.New(t)
+	records, err := ReadSnapshot(strings.NewReader(testSnapshotJSONL))
+	as.Nil(err)
+	as.Len(records, 4)
+
+	records, err = ReadSnapshot(strings.NewReader(`[{"mirror": "tuna", "cname": "debian"}]`))
+	as.Nil(err)
+	as.Equal([]SnapshotRecord{{Mirror: "tuna", CName: "debian"}}, records)
+
+	_, err = ReadSnapshot(strings.NewReader("{}\n{"))
+	as.NotNil(err)
+}
+
+func TestSnapshotSource(t *testing.T) {
+	as := assert.New(t)
+	path := filepath.Join(t.TempDir(), "status.jsonl")
+	as.Nil(os.WriteFile(path, []byte(testSnapshotJSONL), 0644))
+
+	s := NewSnapshotSource(path)
+	as.Nil(s.Reload())
+
+	// latest record wins, disabled records are dropped
+	res, _ := s.Query(context.Background(), "debian")
+	as.Equal(Result{{
+		Value:  -10,
+		Mirror: "tuna",
+		Time:   time.Date(2024, 1, 1, 0, 10, 0, 0, time.UTC),
+		Path:   "/debian",
+	}}, res)
+
+	res, _ = s.Query(context.Background(), "ubuntu")
+	as.Len(res, 1)
+
+	as.Nil(os.Remove(path))
+	as.NotNil(s.Reload())
+	res, _ = s.Query(context.Background(), "ubuntu")
+	as.Len(res, 1)
+}
@@ -0,0 +1,115 @@
+package influxdb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// StaleError is returned along with a stale Result when the underlying query failed.
+type StaleError struct {
+	Age time.Duration // age of the returned Result
+	Err error         // error of the underlying query
+}
+
+func (e *StaleError) Error() string {
+	return fmt.Sprintf("serving stale result of age %s: %v", e.Age.Round(time.Second), e.Err)
+}
+
+func (e *StaleError) Unwrap() error {
+	return e.Err
+}
+
+type staleEntry struct {
+	res  Result
+	time time.Time
+}
+
+// StaleSource remembers the last successful Result of each cname
+// and serves it when the underlying source fails.
+//
+// Results older than maxStaleness are never served.
+type StaleSource struct {
+	src          MirrorStatusSource
+	maxStaleness time.Duration
+	last         sync.Map // map[string]staleEntry
+}
+
+var (
+	_ MirrorStatusSource = (*StaleSource)(nil)
+	_ BatchQuerier       = (*StaleSource)(nil)
+)
+
+// NewStaleSource wraps src to serve stale results up to maxStaleness.
+func NewStaleSource(src MirrorStatusSource, maxStaleness time.Duration) *StaleSource {
+	return &StaleSource{src: src, maxStaleness: maxStaleness}
+}
+
+// Query implements the MirrorStatusSource interface.
+//
+// When a stale Result is served, the error is a *StaleError.
+func (s *StaleSource) Query(ctx context.Context, cname string) (Result, error) {
+	res, err := s.src.Query(ctx, cname)
+	if res != nil {
+		s.remember(cname, res)
+		return res, err
+	}
+
+	stale, age, ok := s.recall(cname)
+	if !ok {
+		return nil, err
+	}
+	return stale, &StaleError{Age: age, Err: err}
+}
+
+// QueryMany implements the BatchQuerier interface.
+//
+// When serving stale results, the age in the *StaleError is that of the oldest one.
+// Cnames without a usable stale result are left out.
+func (s *StaleSource) QueryMany(ctx context.Context, cnames []string) (map[string]Result, error) {
+	m, err := QueryMany(ctx, s.src, cnames)
+	if m != nil {
+		for cname, res := range m {
+			s.remember(cname, res)
+		}
+		return m, err
+	}
+
+	m = make(map[string]Result, len(cnames))
+	var oldest time.Duration
+	for _, cname := range cnames {
+		if stale, age, ok := s.recall(cname); ok {
+			m[cname] = stale
+			oldest = max(oldest, age)
+		}
+	}
+	if len(m) == 0 {
+		return nil, err
+	}
+	return m, &StaleError{Age: oldest, Err: err}
+}
+
+// remember saves a successful non-empty result.
+func (s *StaleSource) remember(cname string, res Result) {
+	if len(res) > 0 {
+		s.last.Store(cname, staleEntry{
+			res:  append(Result(nil), res...),
+			time: time.Now(),
+		})
+	}
+}
+
+// recall returns a copy of the last result of cname if it is not too old.
+func (s *StaleSource) recall(cname string) (res Result, age time.Duration, ok bool) {
+	v, ok := s.last.Load(cname)
+	if !ok {
+		return
+	}
+	entry := v.(staleEntry)
+	age = time.Since(entry.time)
+	if age > s.maxStaleness {
+		return nil, age, false
+	}
+	return append(Result(nil), entry.res...), age, true
+}
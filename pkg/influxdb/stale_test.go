@@ -0,0 +1,55 @@
+package influxdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// failingSource fails every query when fail is set.
+type failingSource struct {
+	MirrorStatusSource
+	fail bool
+}
+
+var errFailing = errors.New("failing")
+
+func (f *failingSource) Query(ctx context.Context, cname string) (Result, error) {
+	if f.fail {
+		return nil, errFailing
+	}
+	return f.MirrorStatusSource.Query(ctx, cname)
+}
+
+func TestStaleSource(t *testing.T) {
+	as := assert.New(t)
+	ctx := context.Background()
+	src := &failingSource{MirrorStatusSource: NewStaticSource(map[string]Result{
+		"debian": {{Mirror: "tuna", Value: -10}},
+	})}
+	s := NewStaleSource(src, time.Hour)
+
+	res, err := s.Query(ctx, "debian")
+	as.Nil(err)
+	as.Len(res, 1)
+
+	src.fail = true
+	res, err = s.Query(ctx, "debian")
+	var staleErr *StaleError
+	as.ErrorAs(err, &staleErr)
+	as.ErrorIs(err, errFailing)
+	as.Equal(Result{{Mirror: "tuna", Value: -10}}, res)
+
+	// never succeeded
+	res, err = s.Query(ctx, "ubuntu")
+	as.Nil(res)
+	as.ErrorIs(err, errFailing)
+
+	// too old
+	s.maxStaleness = 0
+	res, _ = s.Query(ctx, "debian")
+	as.Nil(res)
+}
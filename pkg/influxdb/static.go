@@ -0,0 +1,100 @@
+package influxdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// StaticSource is an in-memory MirrorStatusSource.
+//
+// It is useful for running without InfluxDB and for tests.
+type StaticSource struct {
+	mu   sync.RWMutex
+	data map[string]Result
+}
+
+var (
+	_ MirrorStatusSource = (*StaticSource)(nil)
+	_ AllQuerier         = (*StaticSource)(nil)
+	_ BatchQuerier       = (*StaticSource)(nil)
+)
+
+// NewStaticSource returns a StaticSource serving the given data.
+//
+// The map is owned by the StaticSource afterwards.
+func NewStaticSource(data map[string]Result) *StaticSource {
+	if data == nil {
+		data = make(map[string]Result)
+	}
+	return &StaticSource{data: data}
+}
+
+// Query implements the MirrorStatusSource interface.
+//
+// An unknown cname yields an empty Result.
+func (s *StaticSource) Query(ctx context.Context, cname string) (Result, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make(Result, len(s.data[cname]))
+	copy(res, s.data[cname])
+	return res, nil
+}
+
+// QueryAll implements the AllQuerier interface.
+func (s *StaticSource) QueryAll(ctx context.Context) (map[string]Result, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m := make(map[string]Result, len(s.data))
+	for cname, res := range s.data {
+		m[cname] = append(Result(nil), res...)
+	}
+	return m, nil
+}
+
+// QueryMany implements the BatchQuerier interface.
+func (s *StaticSource) QueryMany(ctx context.Context, cnames []string) (map[string]Result, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m := make(map[string]Result, len(cnames))
+	for _, cname := range cnames {
+		m[cname] = append(make(Result, 0), s.data[cname]...)
+	}
+	return m, nil
+}
+
+// Store replaces the Result of a cname.
+func (s *StaticSource) Store(cname string, res Result) {
+	s.mu.Lock()
+	s.data[cname] = res
+	s.mu.Unlock()
+}
+
+// Replace replaces all data at once.
+func (s *StaticSource) Replace(data map[string]Result) {
+	if data == nil {
+		data = make(map[string]Result)
+	}
+	s.mu.Lock()
+	s.data = data
+	s.mu.Unlock()
+}
+
+// Load replaces all data with the content of a JSON file,
+// which is an object mapping each cname to a list of Items.
+//
+// On error, the existing data is kept.
+func (s *StaticSource) Load(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("StaticSource.Load: %w", err)
+	}
+	var data map[string]Result
+	if err := json.Unmarshal(content, &data); err != nil {
+		return fmt.Errorf("StaticSource.Load: parse %s: %w", path, err)
+	}
+	s.Replace(data)
+	return nil
+}
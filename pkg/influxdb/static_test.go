@@ -0,0 +1,48 @@
+package influxdb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticSource(t *testing.T) {
+	as := assert.New(t)
+	s := NewStaticSource(map[string]Result{
+		"debian": {{Mirror: "tuna", Value: -10, Path: "/debian"}},
+	})
+
+	res, err := s.Query(context.Background(), "debian")
+	as.Nil(err)
+	as.Equal(Result{{Mirror: "tuna", Value: -10, Path: "/debian"}}, res)
+
+	res, err = s.Query(context.Background(), "ubuntu")
+	as.Nil(err)
+	as.NotNil(res)
+	as.Empty(res)
+
+	s.Store("ubuntu", Result{{Mirror: "ustc", Path: "/ubuntu"}})
+	res, _ = s.Query(context.Background(), "ubuntu")
+	as.Len(res, 1)
+}
+
+func TestStaticSourceLoad(t *testing.T) {
+	as := assert.New(t)
+	path := filepath.Join(t.TempDir(), "status.json")
+	content := `{"debian": [{"mirror": "tuna", "value": -5, "path": "/debian"}]}`
+	as.Nil(os.WriteFile(path, []byte(content), 0644))
+
+	s := NewStaticSource(nil)
+	as.Nil(s.Load(path))
+	res, _ := s.Query(context.Background(), "debian")
+	as.Equal(Result{{Mirror: "tuna", Value: -5, Path: "/debian"}}, res)
+
+	// a broken file keeps the old data
+	as.Nil(os.WriteFile(path, []byte("{"), 0644))
+	as.NotNil(s.Load(path))
+	res, _ = s.Query(context.Background(), "debian")
+	as.Len(res, 1)
+}
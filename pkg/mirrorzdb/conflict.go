@@ -0,0 +1,120 @@
+package mirrorzdb
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// ConflictPolicy decides which site keeps a label declared by more than one site.
+type ConflictPolicy string
+
+const (
+	// ConflictFirstWins keeps the label for the site loaded first, in file name order.
+	ConflictFirstWins ConflictPolicy = "first-wins"
+	// ConflictReject keeps the label for none of the sites.
+	ConflictReject ConflictPolicy = "reject"
+	// ConflictNamespace prefixes the label with the site abbr for all of the sites,
+	// e.g. "campus" becomes "tunacampus" for site TUNA.
+	ConflictNamespace ConflictPolicy = "namespace"
+)
+
+// DefaultConflictPolicy is used when no policy is set.
+const DefaultConflictPolicy = ConflictFirstWins
+
+// ParseConflictPolicy checks a policy name, returning DefaultConflictPolicy for an empty one.
+func ParseConflictPolicy(s string) (ConflictPolicy, bool) {
+	switch p := ConflictPolicy(s); p {
+	case "":
+		return DefaultConflictPolicy, true
+	case ConflictFirstWins, ConflictReject, ConflictNamespace:
+		return p, true
+	default:
+		return "", false
+	}
+}
+
+// A Conflict is a label declared by endpoints of more than one site.
+type Conflict struct {
+	Label  string         `json:"label"`
+	Sites  []string       `json:"sites"` // abbrs, in load order
+	Policy ConflictPolicy `json:"policy"`
+	Winner string         `json:"winner,omitempty"` // abbr keeping the label, for first-wins
+	Labels []string       `json:"labels,omitempty"` // labels replacing it, for namespace
+	// Namespaced labels not used since another endpoint already has them, for namespace.
+	// Endpoints that would have them are marked with LabelConflict.
+	Clashes []string `json:"clashes,omitempty"`
+}
+
+// namespaced returns label prefixed by the letters and digits of abbr, in lower case.
+func namespaced(abbr, label string) string {
+	prefix := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, abbr)
+	return prefix + label
+}
+
+// resolveConflicts applies policy to the labels declared by more than one site,
+// renaming endpoints or marking them with LabelConflict.
+// Files sharing an abbr count as one site.
+// A namespaced label already declared by an endpoint, or given to another site, is a clash
+// and the endpoint is marked instead of renamed, so that no label is silently overwritten.
+func resolveConflicts(files []namedFile, policy ConflictPolicy) (conflicts []Conflict) {
+	type ref struct{ file, endpoint int }
+	var labels []string // in order of first declaration
+	refs := make(map[string][]ref)
+	for i, f := range files {
+		for j, e := range f.Endpoints {
+			if _, ok := refs[e.Label]; !ok {
+				labels = append(labels, e.Label)
+			}
+			refs[e.Label] = append(refs[e.Label], ref{i, j})
+		}
+	}
+	taken := make(map[string]string) // namespaced label to the abbr it was given to
+
+	for _, label := range labels {
+		var sites []string
+		for _, r := range refs[label] {
+			if abbr := files[r.file].Site.Abbr; !slices.Contains(sites, abbr) {
+				sites = append(sites, abbr)
+			}
+		}
+		if len(sites) < 2 {
+			continue
+		}
+
+		c := Conflict{Label: label, Sites: sites, Policy: policy}
+		for _, r := range refs[label] {
+			abbr := files[r.file].Site.Abbr
+			e := &files[r.file].Endpoints[r.endpoint]
+			switch policy {
+			case ConflictReject:
+				e.LabelConflict = true
+			case ConflictNamespace:
+				l := namespaced(abbr, label)
+				_, declared := refs[l]
+				if owner, ok := taken[l]; declared || (ok && owner != abbr) {
+					e.LabelConflict = true
+					if !slices.Contains(c.Clashes, l) {
+						c.Clashes = append(c.Clashes, l)
+					}
+					continue
+				}
+				taken[l] = abbr
+				e.Label = l
+				if !slices.Contains(c.Labels, l) {
+					c.Labels = append(c.Labels, l)
+				}
+			default:
+				c.Winner = sites[0]
+				e.LabelConflict = abbr != c.Winner
+			}
+		}
+		conflicts = append(conflicts, c)
+	}
+	return
+}
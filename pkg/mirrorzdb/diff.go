@@ -0,0 +1,65 @@
+package mirrorzdb
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// diff describes the sites and endpoints added, removed and changed from old to new.
+// Sites are matched by abbr and endpoints by label.
+func diff(old, new []MirrorZDFile) (changes []string) {
+	oldSites := make(map[string]*MirrorZDFile, len(old))
+	for i := range old {
+		oldSites[old[i].Site.Abbr] = &old[i]
+	}
+	newSites := make(map[string]bool, len(new))
+
+	for i := range new {
+		n := &new[i]
+		abbr := n.Site.Abbr
+		newSites[abbr] = true
+		o, ok := oldSites[abbr]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("site %s added", abbr))
+			continue
+		}
+		if !reflect.DeepEqual(o.Site, n.Site) {
+			changes = append(changes, fmt.Sprintf("site %s changed", abbr))
+		}
+		changes = append(changes, diffEndpoints(abbr, o.Endpoints, n.Endpoints)...)
+		if !reflect.DeepEqual(o.Mirrors, n.Mirrors) {
+			changes = append(changes, fmt.Sprintf("site %s: mirrors changed", abbr))
+		}
+	}
+	for i := range old {
+		if abbr := old[i].Site.Abbr; !newSites[abbr] {
+			changes = append(changes, fmt.Sprintf("site %s removed", abbr))
+		}
+	}
+	return
+}
+
+// diffEndpoints is like diff for the endpoints of a site.
+func diffEndpoints(abbr string, old, new []Endpoint) (changes []string) {
+	oldEndpoints := make(map[string]*Endpoint, len(old))
+	for i := range old {
+		oldEndpoints[old[i].Label] = &old[i]
+	}
+	newLabels := make(map[string]bool, len(new))
+
+	for i := range new {
+		label := new[i].Label
+		newLabels[label] = true
+		if o, ok := oldEndpoints[label]; !ok {
+			changes = append(changes, fmt.Sprintf("site %s: endpoint %s added", abbr, label))
+		} else if !reflect.DeepEqual(*o, new[i]) {
+			changes = append(changes, fmt.Sprintf("site %s: endpoint %s changed", abbr, label))
+		}
+	}
+	for i := range old {
+		if label := old[i].Label; !newLabels[label] {
+			changes = append(changes, fmt.Sprintf("site %s: endpoint %s removed", abbr, label))
+		}
+	}
+	return
+}
@@ -0,0 +1,102 @@
+package mirrorzdb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mirrorz-org/mirrorz-302/pkg/geo"
+)
+
+// lint returns the mistakes in files that do not prevent loading them,
+// in the order of the files.
+func lint(files []namedFile) (warnings []error) {
+	warn := func(f namedFile, format string, args ...any) {
+		warnings = append(warnings, fmt.Errorf("%s: "+format, append([]any{f.Name}, args...)...))
+	}
+	abbrs := make(map[string]string)  // abbr to file name
+	labels := make(map[string]string) // label to file name
+
+	for _, f := range files {
+		if f.Site.Abbr == "" {
+			warn(f, "site has no abbr")
+		} else if other, ok := abbrs[f.Site.Abbr]; ok {
+			warn(f, "site abbr %s is also used by %s", f.Site.Abbr, other)
+		} else {
+			abbrs[f.Site.Abbr] = f.Name
+		}
+
+		for _, e := range f.Endpoints {
+			if other, ok := labels[e.Label]; ok {
+				warn(f, "endpoint label %s is also used by %s", e.Label, other)
+			} else {
+				labels[e.Label] = f.Name
+			}
+			if strings.HasSuffix(e.Resolve, "/") {
+				warn(f, "endpoint %s resolve %q ends with \"/\"", e.Label, e.Resolve)
+			}
+			if !e.Filter.V4 && !e.Filter.V6 {
+				warn(f, "endpoint %s has neither V4 nor V6 filter", e.Label)
+			}
+			if !e.Filter.SSL && !e.Filter.NOSSL {
+				warn(f, "endpoint %s has neither SSL nor NOSSL filter", e.Label)
+			}
+			for _, filter := range e.Filter.Special {
+				warn(f, "endpoint %s has unknown filter %q", e.Label, filter)
+			}
+			for _, r := range e.RangeInvalid {
+				warn(f, "endpoint %s has invalid range %q", e.Label, r)
+			}
+			for _, region := range e.RangeRegion {
+				if _, ok := geo.LookupPoint(region); !ok {
+					warn(f, "endpoint %s has unknown REGION range %q", e.Label, region)
+				}
+			}
+			for _, city := range e.RangeCity {
+				if _, ok := geo.LookupPoint(city); !ok {
+					warn(f, "endpoint %s has unknown CITY range %q", e.Label, city)
+				}
+			}
+			for _, isp := range e.RangeISP {
+				if !geo.IsISPCode(isp) {
+					warn(f, "endpoint %s has unknown ISP range %q", e.Label, isp)
+				}
+			}
+		}
+	}
+	return
+}
+
+// errorStrings returns the messages of errs.
+func errorStrings(errs []error) []string {
+	s := make([]string, len(errs))
+	for i, err := range errs {
+		s[i] = err.Error()
+	}
+	return s
+}
+
+// lintDir returns the files that cannot be parsed and the problems in the others.
+func lintDir(path string) ([]error, error) {
+	files, errs, err := readDir(path)
+	if err != nil {
+		return nil, err
+	}
+	return append(errs, lint(files)...), nil
+}
+
+// Lint reads the mirrorz.d files in path like Load, returning the problems found
+// instead of logging them. Files that cannot be parsed are reported as well.
+func Lint(path string) (warnings []string, err error) {
+	errs, err := lintDir(path)
+	return errorStrings(errs), err
+}
+
+// Check is like Lint, but joins the problems into one error.
+func Check(path string) error {
+	errs, err := lintDir(path)
+	if err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
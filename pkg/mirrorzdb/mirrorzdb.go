@@ -10,6 +10,7 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/mirrorz-org/mirrorz-302/pkg/geo"
 	"github.com/mirrorz-org/mirrorz-302/pkg/logging"
 	"github.com/mirrorz-org/mirrorz-302/pkg/requestmeta"
 )
@@ -29,11 +30,21 @@ type Endpoint struct {
 		NOSSL   bool
 		Special []string
 	}
-	RangeRegion []string
-	RangeISP    []string
-	RangeCIDR   []*net.IPNet
+	RangeCountry []string // defaults to DefaultCountry
+	RangeRegion  []string
+	RangeCity    []string // city codes or names in the geo table
+	RangeCoord   []geo.Point
+	RangeISP     []string
+	RangeASN     []uint32
+	RangeCIDR    []*net.IPNet
+	RangeInvalid []string // ranges that could not be parsed, ignored
+
+	LabelConflict bool // the label is shared with another site and not used, see Conflict
 }
 
+// DefaultCountry is the country of endpoints without a COUNTRY range.
+const DefaultCountry = "CN"
+
 // endpointJSON is used to parse Endpoint from JSON.
 type endpointJSON struct {
 	Label   string   `json:"label"`
@@ -78,17 +89,41 @@ func (e *Endpoint) UnmarshalJSON(data []byte) error {
 	}
 	// Range
 	for _, d := range j.Range {
-		if region, ok := strings.CutPrefix(d, "REGION:"); ok {
+		if country, ok := strings.CutPrefix(d, "COUNTRY:"); ok {
+			e.RangeCountry = append(e.RangeCountry, strings.ToUpper(country))
+		} else if region, ok := strings.CutPrefix(d, "REGION:"); ok {
 			e.RangeRegion = append(e.RangeRegion, region)
+		} else if city, ok := strings.CutPrefix(d, "CITY:"); ok {
+			e.RangeCity = append(e.RangeCity, city)
+		} else if coord, ok := strings.CutPrefix(d, "COORD:"); ok {
+			if p, err := geo.ParsePoint(coord); err == nil {
+				e.RangeCoord = append(e.RangeCoord, p)
+			} else {
+				e.RangeInvalid = append(e.RangeInvalid, d)
+			}
 		} else if isp, ok := strings.CutPrefix(d, "ISP:"); ok {
+			if code := geo.ISPNameToCode(isp); code != "" {
+				isp = code
+			}
 			e.RangeISP = append(e.RangeISP, isp)
+		} else if strings.HasPrefix(d, "AS") {
+			if asn, err := geo.ParseASN(d); err == nil {
+				e.RangeASN = append(e.RangeASN, asn)
+			} else {
+				e.RangeInvalid = append(e.RangeInvalid, d)
+			}
 		} else {
 			_, ipnet, _ := net.ParseCIDR(d)
 			if ipnet != nil {
 				e.RangeCIDR = append(e.RangeCIDR, ipnet)
+			} else {
+				e.RangeInvalid = append(e.RangeInvalid, d)
 			}
 		}
 	}
+	if len(e.RangeCountry) == 0 {
+		e.RangeCountry = []string{DefaultCountry}
+	}
 	return nil
 }
 
@@ -109,13 +144,43 @@ func (e *Endpoint) Match(m requestmeta.RequestMeta) (reason string, ok bool) {
 		return "label v4only but endpoint not v4only", false
 	case m.V6Only() && !e.Filter.V6Only:
 		return "label v6only but endpoint not v6only", false
-	case !e.Public && !e.MatchISPs(m.ISP) && e.MatchIPMask(m.IP) == 0:
+	case !e.Public && !e.MatchISPs(m.ISP) && !e.MatchASN(m.ASN) && e.MatchIPMask(m.IP) == 0:
 		return "private endpoint", false
 	default:
 		return "OK", true
 	}
 }
 
+// MatchCountry reports if the endpoint is located in the given country.
+func (e *Endpoint) MatchCountry(country string) bool {
+	for _, r := range e.RangeCountry {
+		if r == country {
+			return true
+		}
+	}
+	return false
+}
+
+// Positions returns the positions of the endpoint at the finest level declared:
+// COORD ranges, then CITY ranges, then REGION ranges.
+// Cities and regions not in the geo table are ignored.
+func (e *Endpoint) Positions() (points []geo.Point) {
+	if len(e.RangeCoord) > 0 {
+		return e.RangeCoord
+	}
+	for _, ranges := range [][]string{e.RangeCity, e.RangeRegion} {
+		for _, r := range ranges {
+			if p, ok := geo.LookupPoint(r); ok {
+				points = append(points, p)
+			}
+		}
+		if len(points) > 0 {
+			return
+		}
+	}
+	return
+}
+
 // MatchISP reports if the given ISP is preferred by the endpoint.
 func (e *Endpoint) MatchISP(isp string) bool {
 	for _, r := range e.RangeISP {
@@ -136,6 +201,19 @@ func (e *Endpoint) MatchISPs(isps []string) bool {
 	return false
 }
 
+// MatchASN reports if the given AS number is preferred by the endpoint.
+func (e *Endpoint) MatchASN(asn uint32) bool {
+	if asn == 0 {
+		return false
+	}
+	for _, r := range e.RangeASN {
+		if r == asn {
+			return true
+		}
+	}
+	return false
+}
+
 // MatchIP reports if the given IP is preferred by the endpoint.
 //
 // Returns the longest matched CIDR.
@@ -170,8 +248,24 @@ type MirrorZDFile struct {
 }
 
 type MirrorMapItem struct {
-	Abbr string
-	Path string
+	Abbr    string
+	Path    string
+	CName   string // as declared in mirrorz.d.json, before normalization
+	Status  string
+	Disable bool
+}
+
+// StatusCode returns the current status letter of a mirrorz status string,
+// e.g. "S" for "S1624546695X1624553695", or an empty string if there is none.
+func StatusCode(status string) string {
+	if status == "" {
+		return ""
+	}
+	c := status[0]
+	if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') {
+		return strings.ToUpper(status[:1])
+	}
+	return ""
 }
 
 type MirrorZDatabase struct {
@@ -180,57 +274,125 @@ type MirrorZDatabase struct {
 	labelMap  map[string]string
 	abbrMap   map[string]*MirrorZDFile
 	mirrorMap map[string][]MirrorMapItem
+	warnings  []string
+	conflicts []Conflict
+
+	policy         ConflictPolicy
+	errorThreshold int
 }
 
 func NewMirrorZDatabase() *MirrorZDatabase {
-	return new(MirrorZDatabase)
+	return &MirrorZDatabase{policy: DefaultConflictPolicy}
+}
+
+// SetConflictPolicy sets the policy for label conflicts, applied from the next Load.
+func (m *MirrorZDatabase) SetConflictPolicy(policy ConflictPolicy) {
+	m.mu.Lock()
+	m.policy = policy
+	m.mu.Unlock()
+}
+
+// SetErrorThreshold sets the number of files failing to load that makes Load
+// keep the current database, 0 to always accept the files that can be loaded.
+// The first Load always accepts the files that can be loaded.
+func (m *MirrorZDatabase) SetErrorThreshold(n int) {
+	m.mu.Lock()
+	m.errorThreshold = n
+	m.mu.Unlock()
 }
 
 func NormalizeCname(cname string) string {
 	return strings.ReplaceAll(cname, "-", "")
 }
 
+// namedFile is a parsed mirrorz.d file and its file name.
+type namedFile struct {
+	Name string
+	MirrorZDFile
+}
+
+// readDir parses the mirrorz.d files in path.
+// Files that cannot be read or parsed are skipped and reported in errs.
+func readDir(path string) (files []namedFile, errs []error, err error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(path, entry.Name()))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var data MirrorZDFile
+		if err := json.Unmarshal(content, &data); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", entry.Name(), err))
+			continue
+		}
+		files = append(files, namedFile{entry.Name(), data})
+	}
+	return
+}
+
 func (m *MirrorZDatabase) Load(path string) (err error) {
-	files, err := os.ReadDir(path)
+	files, errs, err := readDir(path)
 	if err != nil {
 		err = fmt.Errorf("MirrorZDatabase.Load: os.ReadDir: %w", err)
 		logger.Errorf("%v\n", err)
 		return
 	}
+	for _, err := range errs {
+		logger.Errorf("LoadMirrorZD: %v\n", err)
+	}
+	m.mu.RLock()
+	policy, threshold, loaded := m.policy, m.errorThreshold, m.files != nil
+	m.mu.RUnlock()
+	// on the first load, there is no database to keep
+	if loaded && threshold > 0 && len(errs) >= threshold {
+		err = fmt.Errorf("MirrorZDatabase.Load: %d files failed to load, keeping the current database", len(errs))
+		logger.Errorf("%v\n", err)
+		return
+	}
+	warnings := lint(files)
+	for _, err := range warnings {
+		logger.Warningf("LoadMirrorZD: %v\n", err)
+	}
+	conflicts := resolveConflicts(files, policy)
+	for _, c := range conflicts {
+		logger.Warningf("LoadMirrorZD: label %s is declared by sites %s, applying %s\n",
+			c.Label, strings.Join(c.Sites, ", "), c.Policy)
+	}
 
 	newFiles := make([]MirrorZDFile, 0, len(files))
 	newLabelMap := make(map[string]string)
 	newAbbrMap := make(map[string]*MirrorZDFile)
 	newMirrorMap := make(map[string][]MirrorMapItem)
 
-	for _, file := range files {
-		if !strings.HasSuffix(file.Name(), ".json") {
-			continue
-		}
-		content, err := os.ReadFile(filepath.Join(path, file.Name()))
-		if err != nil {
-			logger.Errorf("LoadMirrorZD: read %s failed\n", file.Name())
-			continue
-		}
-		var data MirrorZDFile
-		if err := json.Unmarshal(content, &data); err != nil {
-			logger.Errorf("LoadMirrorZD: Parse %s error: %v\n", file.Name(), err)
-			continue
-		}
+	for _, f := range files {
+		data := f.MirrorZDFile
 		logger.Infof("%+v\n", data)
 		idx := len(newFiles)
 		newFiles = append(newFiles, data)
 		newAbbrMap[data.Site.Abbr] = &newFiles[idx]
 
 		for _, e := range data.Endpoints {
-			newLabelMap[e.Label] = e.Resolve
+			if !e.LabelConflict {
+				newLabelMap[e.Label] = e.Resolve
+			}
 		}
 
 		for i := range data.Mirrors {
-			data.Mirrors[i].CName = NormalizeCname(data.Mirrors[i].CName)
+			cname := data.Mirrors[i].CName
+			data.Mirrors[i].CName = NormalizeCname(cname)
 			newMirrorMap[data.Mirrors[i].CName] = append(newMirrorMap[data.Mirrors[i].CName], MirrorMapItem{
-				Abbr: data.Site.Abbr,
-				Path: data.Mirrors[i].URL,
+				Abbr:    data.Site.Abbr,
+				Path:    data.Mirrors[i].URL,
+				CName:   cname,
+				Status:  data.Mirrors[i].Status,
+				Disable: data.Mirrors[i].Disable,
 			})
 		}
 		sort.Slice(data.Mirrors, func(i, j int) bool {
@@ -241,11 +403,20 @@ func (m *MirrorZDatabase) Load(path string) (err error) {
 		logger.Infof("%s -> %s\n", label, resolve)
 	}
 	m.mu.Lock()
+	oldFiles := m.files
 	m.files = newFiles
 	m.labelMap = newLabelMap
 	m.abbrMap = newAbbrMap
 	m.mirrorMap = newMirrorMap
+	m.warnings = errorStrings(append(errs, warnings...))
+	m.conflicts = conflicts
 	m.mu.Unlock()
+
+	if oldFiles != nil {
+		for _, change := range diff(oldFiles, newFiles) {
+			logger.Infof("LoadMirrorZD: %s\n", change)
+		}
+	}
 	return
 }
 
@@ -258,6 +429,22 @@ func (m *MirrorZDatabase) Files() []MirrorZDFile {
 	return m.files
 }
 
+// Warnings returns the problems found by the last Load,
+// including files that were skipped.
+func (m *MirrorZDatabase) Warnings() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.warnings
+}
+
+// Conflicts returns the labels declared by more than one site in the last Load,
+// and how they were resolved.
+func (m *MirrorZDatabase) Conflicts() []Conflict {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.conflicts
+}
+
 // Lookup returns the endpoints of the site.
 func (m *MirrorZDatabase) Lookup(abbr string) (endpoints []Endpoint, ok bool) {
 	m.mu.RLock()
@@ -283,3 +470,33 @@ func (m *MirrorZDatabase) Query(cname string) (mirrors []MirrorMapItem, ok bool)
 	m.mu.RUnlock()
 	return
 }
+
+// Mirror returns the mirror of a site for a (normalized) cname.
+func (m *MirrorZDatabase) Mirror(cname, abbr string) (mirror MirrorMapItem, ok bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, mirror := range m.mirrorMap[cname] {
+		if mirror.Abbr == abbr {
+			return mirror, true
+		}
+	}
+	return
+}
+
+// CNames returns all cnames as declared in mirrorz.d.json files, sorted.
+func (m *MirrorZDatabase) CNames() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	set := make(map[string]struct{})
+	for _, mirrors := range m.mirrorMap {
+		for _, mirror := range mirrors {
+			set[mirror.CName] = struct{}{}
+		}
+	}
+	cnames := make([]string, 0, len(set))
+	for cname := range set {
+		cnames = append(cnames, cname)
+	}
+	sort.Strings(cnames)
+	return cnames
+}
@@ -0,0 +1,259 @@
+package mirrorzdb
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mirrorz-org/mirrorz-302/pkg/geo"
+	"github.com/mirrorz-org/mirrorz-302/pkg/requestmeta"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpointCountry(t *testing.T) {
+	as := assert.New(t)
+	var e Endpoint
+	as.Nil(json.Unmarshal([]byte(`{"label": "a", "range": ["REGION:BJ"]}`), &e))
+	as.Equal([]string{DefaultCountry}, e.RangeCountry)
+	as.True(e.MatchCountry("CN"))
+
+	e = Endpoint{}
+	as.Nil(json.Unmarshal([]byte(`{"label": "b", "range": ["COUNTRY:us", "COUNTRY:JP"]}`), &e))
+	as.Equal([]string{"US", "JP"}, e.RangeCountry)
+	as.False(e.MatchCountry("CN"))
+	as.True(e.MatchCountry("JP"))
+}
+
+func TestEndpointASN(t *testing.T) {
+	as := assert.New(t)
+	var e Endpoint
+	as.Nil(json.Unmarshal([]byte(`{
+		"label": "campus",
+		"public": false,
+		"filter": ["V4", "NOSSL"],
+		"range": ["AS4134", "AS4809", "ASX"]
+	}`), &e))
+	as.Equal([]uint32{4134, 4809}, e.RangeASN)
+	as.True(e.MatchASN(4809))
+	as.False(e.MatchASN(0))
+
+	m := requestmeta.RequestMeta{Scheme: "http", IP: net.ParseIP("192.0.2.1")}
+	_, ok := e.Match(m)
+	as.False(ok)
+	m.ASN = 4134
+	_, ok = e.Match(m)
+	as.True(ok)
+}
+
+func TestEndpointPositions(t *testing.T) {
+	as := assert.New(t)
+	var e Endpoint
+	as.Nil(json.Unmarshal([]byte(`{"label": "a", "range": ["REGION:XJ", "REGION:XX"]}`), &e))
+	xj, _ := geo.LookupPoint("XJ")
+	as.Equal([]geo.Point{xj}, e.Positions())
+
+	e = Endpoint{}
+	as.Nil(json.Unmarshal([]byte(`{"label": "b", "range": ["REGION:XJ", "CITY:新疆", "COORD:39.47,75.99", "COORD:bad"]}`), &e))
+	as.Equal([]string{"新疆"}, e.RangeCity)
+	as.Equal([]geo.Point{{Latitude: 39.47, Longitude: 75.99}}, e.Positions())
+}
+
+// writeFile writes a fixture to dir, failing the test if it cannot.
+func writeFile(t *testing.T, dir, name string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// site returns a mirrorz.d.json of a site with the given endpoints.
+func site(abbr, endpoints string) []byte {
+	return []byte(`{"site": {"abbr": "` + abbr + `"}, "endpoints": [` + endpoints + `]}`)
+}
+
+func TestCheck(t *testing.T) {
+	as := assert.New(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.json", []byte(`{
+  "site": {"abbr": "A"},
+  "endpoints": [{"label": "a", "range": ["ISP:CERNET", "ISP:NOSUCHISP"]}]
+}`))
+	writeFile(t, dir, "b.json", []byte(`{"site": `))
+	writeFile(t, dir, "README", []byte(`not json`))
+
+	err := Check(dir)
+	if as.NotNil(err) {
+		as.Contains(err.Error(), `a.json: endpoint a has unknown ISP range "NOSUCHISP"`)
+		as.Contains(err.Error(), "b.json: ")
+		as.NotContains(err.Error(), "README")
+	}
+	as.NotNil(Check(filepath.Join(dir, "missing")))
+}
+
+func TestLint(t *testing.T) {
+	as := assert.New(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.json", []byte(`{
+  "site": {"abbr": "A"},
+  "endpoints": [
+    {"label": "a", "resolve": "a.example.edu.cn/", "filter": ["V4", "SSL", "SSL:centos"],
+     "range": ["REGION:ZZ", "CITY:Atlantis", "COORD:91,0", "ASX", "10.0.0.0/33", "10.0.0.0/8", "REGION:BJ"]},
+    {"label": "b", "resolve": "b.example.edu.cn", "filter": ["NOSSL"]}
+  ]
+}`))
+	writeFile(t, dir, "b.json", []byte(`{
+  "site": {"abbr": "A"},
+  "endpoints": [{"label": "a", "resolve": "b.example.edu.cn", "filter": ["V4", "V6", "SSL", "NOSSL"]}]
+}`))
+
+	warnings, err := Lint(dir)
+	as.Nil(err)
+	as.Equal([]string{
+		`a.json: endpoint a resolve "a.example.edu.cn/" ends with "/"`,
+		`a.json: endpoint a has unknown filter "SSL:centos"`,
+		`a.json: endpoint a has invalid range "COORD:91,0"`,
+		`a.json: endpoint a has invalid range "ASX"`,
+		`a.json: endpoint a has invalid range "10.0.0.0/33"`,
+		`a.json: endpoint a has unknown REGION range "ZZ"`,
+		`a.json: endpoint a has unknown CITY range "Atlantis"`,
+		`a.json: endpoint b has neither V4 nor V6 filter`,
+		`b.json: site abbr A is also used by a.json`,
+		`b.json: endpoint label a is also used by a.json`,
+	}, warnings)
+
+	m := NewMirrorZDatabase()
+	as.Nil(m.Load(dir))
+	as.Equal(warnings, m.Warnings())
+}
+
+func TestConflicts(t *testing.T) {
+	as := assert.New(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.json", site("TUNA", `
+    {"label": "campus", "resolve": "a.example.edu.cn"},
+    {"label": "tuna", "resolve": "tuna.example.edu.cn"}`))
+	writeFile(t, dir, "b.json", site("SJTUG-siyuan", `
+    {"label": "campus", "resolve": "b.example.edu.cn"}`))
+
+	m := NewMirrorZDatabase()
+	as.Nil(m.Load(dir))
+	as.Equal([]Conflict{{Label: "campus", Sites: []string{"TUNA", "SJTUG-siyuan"}, Policy: ConflictFirstWins, Winner: "TUNA"}}, m.Conflicts())
+	resolve, _ := m.ResolveLabel("campus")
+	as.Equal("a.example.edu.cn", resolve)
+	endpoints, _ := m.Lookup("SJTUG-siyuan")
+	as.True(endpoints[0].LabelConflict)
+
+	m.SetConflictPolicy(ConflictReject)
+	as.Nil(m.Load(dir))
+	_, ok := m.ResolveLabel("campus")
+	as.False(ok)
+	endpoints, _ = m.Lookup("TUNA")
+	as.True(endpoints[0].LabelConflict)
+	as.False(endpoints[1].LabelConflict)
+
+	m.SetConflictPolicy(ConflictNamespace)
+	as.Nil(m.Load(dir))
+	as.Equal([]string{"tunacampus", "sjtugsiyuancampus"}, m.Conflicts()[0].Labels)
+	resolve, _ = m.ResolveLabel("sjtugsiyuancampus")
+	as.Equal("b.example.edu.cn", resolve)
+	_, ok = m.ResolveLabel("campus")
+	as.False(ok)
+	endpoints, _ = m.Lookup("TUNA")
+	as.False(endpoints[0].LabelConflict)
+}
+
+func TestConflictsNamespaceClash(t *testing.T) {
+	as := assert.New(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.json", site("TUNA", `
+    {"label": "campus", "resolve": "a.example.edu.cn"}`))
+	writeFile(t, dir, "b.json", site("B", `
+    {"label": "campus", "resolve": "b.example.edu.cn"},
+    {"label": "tunacampus", "resolve": "b2.example.edu.cn"}`))
+	writeFile(t, dir, "c.json", site("T-UNA", `
+    {"label": "campus", "resolve": "c.example.edu.cn"}`))
+
+	m := NewMirrorZDatabase()
+	m.SetConflictPolicy(ConflictNamespace)
+	as.Nil(m.Load(dir))
+	as.Equal([]Conflict{{
+		Label:   "campus",
+		Sites:   []string{"TUNA", "B", "T-UNA"},
+		Policy:  ConflictNamespace,
+		Labels:  []string{"bcampus"},
+		Clashes: []string{"tunacampus"},
+	}}, m.Conflicts())
+	resolve, _ := m.ResolveLabel("tunacampus")
+	as.Equal("b2.example.edu.cn", resolve, "a namespaced label should not overwrite a declared one")
+	for _, abbr := range []string{"TUNA", "T-UNA"} {
+		endpoints, _ := m.Lookup(abbr)
+		as.True(endpoints[0].LabelConflict, abbr)
+	}
+
+	// without b2, TUNA gets the label first and T-UNA clashes with it
+	writeFile(t, dir, "b.json", site("B", `
+    {"label": "campus", "resolve": "b.example.edu.cn"}`))
+	as.Nil(m.Load(dir))
+	as.Equal([]string{"tunacampus", "bcampus"}, m.Conflicts()[0].Labels)
+	as.Equal([]string{"tunacampus"}, m.Conflicts()[0].Clashes)
+	resolve, _ = m.ResolveLabel("tunacampus")
+	as.Equal("a.example.edu.cn", resolve)
+	endpoints, _ := m.Lookup("T-UNA")
+	as.True(endpoints[0].LabelConflict)
+}
+
+func TestDiff(t *testing.T) {
+	as := assert.New(t)
+	old := []MirrorZDFile{
+		{Site: Site{Abbr: "A"}, Endpoints: []Endpoint{{Label: "a", Resolve: "a.example.edu.cn"}, {Label: "a6"}}},
+		{Site: Site{Abbr: "B"}},
+	}
+	new := []MirrorZDFile{
+		{Site: Site{Abbr: "A"}, Endpoints: []Endpoint{{Label: "a", Resolve: "a.example.com"}, {Label: "a4"}},
+			Mirrors: []MirrorItem{{CName: "debian"}}},
+		{Site: Site{Abbr: "C"}},
+	}
+	as.Equal([]string{
+		"site A: endpoint a changed",
+		"site A: endpoint a4 added",
+		"site A: endpoint a6 removed",
+		"site A: mirrors changed",
+		"site C added",
+		"site B removed",
+	}, diff(old, new))
+	as.Empty(diff(new, new))
+}
+
+func TestLoadErrorThreshold(t *testing.T) {
+	as := assert.New(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "a.json", []byte(`{"site": {"abbr": "A"}}`))
+	writeFile(t, dir, "x.json", []byte(`{`))
+	writeFile(t, dir, "y.json", []byte(`{`))
+	m := NewMirrorZDatabase()
+	m.SetErrorThreshold(2)
+
+	// the first load has no database to keep
+	as.Nil(m.Load(dir))
+	as.Len(m.Files(), 1)
+	os.Remove(filepath.Join(dir, "x.json"))
+	os.Remove(filepath.Join(dir, "y.json"))
+	as.Nil(m.Load(dir))
+
+	// one broken file is skipped
+	writeFile(t, dir, "b.json", []byte(`{"site": {"abbr": "B"}}`))
+	writeFile(t, dir, "c.json", []byte(`{`))
+	as.Nil(m.Load(dir))
+	as.Len(m.Files(), 2)
+
+	// two keep the current database
+	writeFile(t, dir, "a.json", []byte(`{`))
+	as.NotNil(m.Load(dir))
+	as.Len(m.Files(), 2)
+
+	m.SetErrorThreshold(0)
+	as.Nil(m.Load(dir))
+	as.Len(m.Files(), 1)
+}
@@ -0,0 +1,253 @@
+// Package proxyproto implements a listener accepting the PROXY protocol
+// (https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt), versions 1 and 2.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mirrorz-org/mirrorz-302/pkg/logging"
+)
+
+var logger = logging.GetLogger("proxyproto")
+
+var (
+	v1Signature = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// v1MaxLength is the maximum length of a v1 header, including the CRLF.
+const v1MaxLength = 107
+
+// DefaultHeaderTimeout is the default time allowed for reading a header.
+const DefaultHeaderTimeout = 5 * time.Second
+
+// ErrUntrusted is returned when a PROXY header is sent by an untrusted peer.
+var ErrUntrusted = errors.New("proxyproto: PROXY header from untrusted peer")
+
+// A Listener wraps a net.Listener to read PROXY headers from trusted peers.
+//
+// Connections from trusted peers may start with a PROXY header,
+// in which case RemoteAddr returns the client address in the header.
+// Connections from other peers are rejected if they start with a PROXY header.
+type Listener struct {
+	net.Listener
+	Trusted       func(ip net.IP) bool // nil trusts no peer
+	HeaderTimeout time.Duration        // 0 for DefaultHeaderTimeout
+}
+
+// NewListener returns a Listener accepting PROXY headers from peers for which trusted returns true.
+func NewListener(inner net.Listener, trusted func(ip net.IP) bool) *Listener {
+	return &Listener{Listener: inner, Trusted: trusted}
+}
+
+// Accept implements the net.Listener interface.
+//
+// The header is read on the first call to Read or RemoteAddr,
+// so that a slow peer does not block the accept loop.
+// http.Server calls RemoteAddr first, before setting its own deadlines.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, l: l, r: bufio.NewReader(conn)}, nil
+}
+
+// A Conn is a connection accepted by a Listener.
+type Conn struct {
+	net.Conn
+	l *Listener
+	r *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	proxy  bool
+	err    error
+}
+
+func (c *Conn) init() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		timeout := c.l.HeaderTimeout
+		if timeout == 0 {
+			timeout = DefaultHeaderTimeout
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+
+		addr, proxy, err := readHeader(c.r)
+		if err == nil && proxy && !c.trusted() {
+			err = ErrUntrusted
+		}
+		if err != nil {
+			c.err = err
+			logger.Warningf("Rejecting connection from %s: %v\n", c.remote, err)
+			c.Conn.Close()
+			return
+		}
+		if addr != nil {
+			c.remote = addr
+			c.proxy = true
+		}
+	})
+}
+
+func (c *Conn) trusted() bool {
+	if c.l.Trusted == nil {
+		return false
+	}
+	tcpAddr, ok := c.Conn.RemoteAddr().(*net.TCPAddr)
+	return ok && c.l.Trusted(tcpAddr.IP)
+}
+
+// Read implements the net.Conn interface.
+// If the PROXY header is invalid or not allowed, the connection is closed and Read fails.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY header,
+// or the peer address if there is none.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// Proxied reports if the connection started with a PROXY header carrying a client address.
+func (c *Conn) Proxied() bool {
+	c.init()
+	return c.proxy
+}
+
+type connKey struct{}
+
+// ConnContext can be used as http.Server.ConnContext,
+// so that Proxied can tell requests received through a PROXY header.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		c = tlsConn.NetConn()
+	}
+	if conn, ok := c.(*Conn); ok {
+		ctx = context.WithValue(ctx, connKey{}, conn)
+	}
+	return ctx
+}
+
+// Proxied reports if the request with the given context was received
+// through a PROXY header carrying the client address.
+func Proxied(ctx context.Context) bool {
+	conn, ok := ctx.Value(connKey{}).(*Conn)
+	return ok && conn.Proxied()
+}
+
+// readHeader reads a PROXY header, if there is one.
+//
+// addr is nil if there is no header, or if the header does not carry
+// a client address (v1 UNKNOWN, v2 LOCAL or unspecified family).
+func readHeader(r *bufio.Reader) (addr net.Addr, proxy bool, err error) {
+	peek, err := r.Peek(len(v2Signature))
+	if err != nil && !(errors.Is(err, io.EOF) && len(peek) > 0) {
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+		return nil, false, err
+	}
+	switch {
+	case bytes.HasPrefix(peek, v1Signature):
+		addr, err = readV1(r)
+	case bytes.Equal(peek, v2Signature):
+		addr, err = readV2(r)
+	default:
+		return nil, false, nil
+	}
+	return addr, true, err
+}
+
+// readV1 reads a human-readable v1 header, e.g.
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("proxyproto: v1 header: %w", err)
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxyproto: v1 header too long")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("proxyproto: invalid v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("proxyproto: invalid v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readV2 reads a binary v2 header.
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("proxyproto: v2 header: %w", err)
+	}
+	verCmd, family := header[12], header[13]
+	length := binary.BigEndian.Uint16(header[14:])
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("proxyproto: v2 header: %w", err)
+	}
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("proxyproto: unsupported v2 version %d", verCmd>>4)
+	}
+	switch verCmd & 0xf {
+	case 0: // LOCAL, e.g. health checks
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("proxyproto: unsupported v2 command %d", verCmd&0xf)
+	}
+
+	var ipLen int
+	switch family >> 4 {
+	case 1: // AF_INET
+		ipLen = net.IPv4len
+	case 2: // AF_INET6
+		ipLen = net.IPv6len
+	default: // AF_UNSPEC or AF_UNIX
+		return nil, nil
+	}
+	// source address, destination address, source port, destination port
+	if len(payload) < 2*ipLen+4 {
+		return nil, errors.New("proxyproto: v2 address block too short")
+	}
+	ip := net.IP(append([]byte(nil), payload[:ipLen]...))
+	port := binary.BigEndian.Uint16(payload[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
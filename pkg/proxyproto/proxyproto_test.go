@@ -0,0 +1,130 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func v2Header(cmd, family byte, src net.IP, port uint16) []byte {
+	var addrs []byte
+	if ip4 := src.To4(); ip4 != nil {
+		addrs = append(addrs, ip4...)
+		addrs = append(addrs, 192, 0, 2, 254)
+	} else if src != nil {
+		addrs = append(addrs, src.To16()...)
+		addrs = append(addrs, net.IPv6loopback...)
+	}
+	if src != nil {
+		addrs = binary.BigEndian.AppendUint16(addrs, port)
+		addrs = binary.BigEndian.AppendUint16(addrs, 443)
+	}
+	header := append([]byte(nil), v2Signature...)
+	header = append(header, 0x20|cmd, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func TestReadHeader(t *testing.T) {
+	as := assert.New(t)
+	cases := []struct {
+		input string
+		addr  string
+		proxy bool
+		err   bool
+	}{
+		{"GET / HTTP/1.1\r\n", "", false, false},
+		{"", "", false, false},
+		{"GET", "", false, false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET", "192.0.2.1:56324", true, false},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\nGET", "[2001:db8::1]:56324", true, false},
+		{"PROXY UNKNOWN\r\nGET", "", true, false},
+		{"PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n", "", true, true},
+		{"PROXY TCP4 192.0.2.1\r\n", "", true, true},
+		{"PROXY " + strings.Repeat("x", 200), "", true, true},
+		{string(v2Header(1, 0x11, net.ParseIP("192.0.2.1"), 56324)) + "GET", "192.0.2.1:56324", true, false},
+		{string(v2Header(1, 0x21, net.ParseIP("2001:db8::1"), 56324)) + "GET", "[2001:db8::1]:56324", true, false},
+		{string(v2Header(0, 0x00, nil, 0)) + "GET", "", true, false},
+		{string(v2Header(1, 0x11, nil, 0)), "", true, true},
+	}
+	for _, c := range cases {
+		r := bufio.NewReader(strings.NewReader(c.input))
+		addr, proxy, err := readHeader(r)
+		as.Equal(c.proxy, proxy, "%q", c.input)
+		as.Equal(c.err, err != nil, "%q: %v", c.input, err)
+		if c.addr == "" {
+			as.Nil(addr, "%q", c.input)
+		} else if as.NotNil(addr, "%q", c.input) {
+			as.Equal(c.addr, addr.String())
+		}
+		if !c.err && strings.HasSuffix(c.input, "GET") {
+			rest, _ := io.ReadAll(r)
+			as.Equal("GET", string(rest), "%q", c.input)
+		}
+	}
+}
+
+// serve starts an HTTP server replying with the remote address and whether it was proxied.
+func serve(t *testing.T, trusted bool) string {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := NewListener(inner, func(net.IP) bool { return trusted })
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proxied := "direct"
+			if Proxied(r.Context()) {
+				proxied = "proxied"
+			}
+			io.WriteString(w, r.RemoteAddr+" "+proxied)
+		}),
+		ConnContext: ConnContext,
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return inner.Addr().String()
+}
+
+func request(t *testing.T, addr, header string) (string, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, header+"GET / HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestListener(t *testing.T) {
+	as := assert.New(t)
+	const header = "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+
+	addr := serve(t, true)
+	body, err := request(t, addr, header)
+	as.Nil(err)
+	as.Equal("192.0.2.1:56324 proxied", body)
+	body, err = request(t, addr, "")
+	as.Nil(err)
+	as.True(strings.HasPrefix(body, "127.0.0.1:"), body)
+	as.True(strings.HasSuffix(body, " direct"), body)
+
+	addr = serve(t, false)
+	_, err = request(t, addr, header)
+	as.NotNil(err, "PROXY header from untrusted peer should be rejected")
+	body, err = request(t, addr, "")
+	as.Nil(err)
+	as.True(strings.HasSuffix(body, " direct"), body)
+}
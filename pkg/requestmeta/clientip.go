@@ -0,0 +1,142 @@
+package requestmeta
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mirrorz-org/mirrorz-302/pkg/proxyproto"
+)
+
+// Sources of the client IP, as recorded in RequestMeta.IPSource.
+const (
+	IPSourceRemote        = "remote"
+	IPSourceProxyProtocol = "proxy-protocol"
+	IPSourceForwarded     = "forwarded"
+	IPSourceXForwardedFor = "x-forwarded-for"
+	IPSourceXRealIP       = "x-real-ip"
+)
+
+// DefaultTrustedProxies are the proxies trusted when none are configured.
+var DefaultTrustedProxies = []string{"127.0.0.0/8", "::1/128"}
+
+// ParseCIDRs parses a list of CIDR prefixes or single IP addresses.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+var defaultTrustedNets, _ = ParseCIDRs(DefaultTrustedProxies)
+
+// Trusted reports if ip is a trusted proxy.
+func (p *Parser) Trusted(ip net.IP) bool {
+	nets := p.TrustedProxies
+	if nets == nil {
+		nets = defaultTrustedNets
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHost parses an IP address with an optional port,
+// e.g. "192.0.2.1", "192.0.2.1:80", "[2001:db8::1]:80" or "2001:db8::1".
+func parseHost(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+}
+
+// forwardedFor returns the "for" parameters of an RFC 7239 Forwarded header, in order.
+// Elements without one yield an empty string.
+func forwardedFor(values []string) (hops []string) {
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				key, val, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(key, "for") {
+					hop = strings.Trim(val, `"`)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return
+}
+
+// xForwardedFor returns the addresses in X-Forwarded-For headers, in order.
+func xForwardedFor(values []string) (hops []string) {
+	for _, value := range values {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	return
+}
+
+// walkHops returns the client IP from a list of hops, starting from ip,
+// the address of the peer that appended the last hop.
+//
+// The hops are walked right to left while the current address is a trusted proxy.
+// An unparsable hop (e.g. "unknown" or an obfuscated identifier) ends the walk.
+func (p *Parser) walkHops(ip net.IP, hops []string) net.IP {
+	for i := len(hops) - 1; i >= 0 && p.Trusted(ip); i-- {
+		hop := parseHost(hops[i])
+		if hop == nil {
+			break
+		}
+		ip = hop
+	}
+	return ip
+}
+
+// IP returns the client IP of a request and where it was taken from.
+//
+// The client address from the PROXY header is returned as is, if there was one,
+// since the client itself may send forwarding headers.
+// Otherwise, forwarding headers are only used if the peer is a trusted proxy.
+// In that order, Forwarded, X-Forwarded-For and X-Real-IP are tried,
+// otherwise the peer address is returned.
+func (p *Parser) IP(r *http.Request) (ip net.IP, source string) {
+	ip = parseHost(r.RemoteAddr)
+	if proxyproto.Proxied(r.Context()) {
+		return ip, IPSourceProxyProtocol
+	}
+	if ip == nil || !p.Trusted(ip) {
+		return ip, IPSourceRemote
+	}
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		return p.walkHops(ip, forwardedFor(values)), IPSourceForwarded
+	}
+	if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		return p.walkHops(ip, xForwardedFor(values)), IPSourceXForwardedFor
+	}
+	if realIP := net.ParseIP(r.Header.Get("X-Real-IP")); realIP != nil {
+		return realIP, IPSourceXRealIP
+	}
+	return ip, IPSourceRemote
+}
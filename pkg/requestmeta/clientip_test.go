@@ -0,0 +1,136 @@
+package requestmeta
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mirrorz-org/mirrorz-302/pkg/proxyproto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	as := assert.New(t)
+	nets, err := ParseCIDRs([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::1"})
+	as.Nil(err)
+	if as.Len(nets, 3) {
+		as.True(nets[1].Contains(net.ParseIP("192.0.2.1")))
+		as.False(nets[1].Contains(net.ParseIP("192.0.2.2")))
+		as.True(nets[2].Contains(net.ParseIP("2001:db8::1")))
+	}
+	_, err = ParseCIDRs([]string{"10.0.0.0/33"})
+	as.NotNil(err)
+	_, err = ParseCIDRs([]string{"localhost"})
+	as.NotNil(err)
+}
+
+func TestClientIP(t *testing.T) {
+	as := assert.New(t)
+	trusted, _ := ParseCIDRs([]string{"127.0.0.1", "10.0.0.0/8"})
+	p := &Parser{TrustedProxies: trusted}
+
+	cases := []struct {
+		remote  string
+		headers map[string]string
+		ip      string
+		source  string
+	}{
+		{"198.51.100.1:1234", map[string]string{"X-Real-IP": "192.0.2.1"}, "198.51.100.1", IPSourceRemote},
+		{"127.0.0.1:1234", nil, "127.0.0.1", IPSourceRemote},
+		{"127.0.0.1:1234", map[string]string{"X-Real-IP": "192.0.2.1"}, "192.0.2.1", IPSourceXRealIP},
+		{"127.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.9, 192.0.2.1, 10.0.0.2"}, "192.0.2.1", IPSourceXForwardedFor},
+		{"127.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3", IPSourceXForwardedFor},
+		{"[::1]:1234", map[string]string{"X-Forwarded-For": "192.0.2.1"}, "::1", IPSourceRemote},
+		{"127.0.0.1:1234", map[string]string{
+			"Forwarded":       `for=192.0.2.9, for="[2001:db8::1]:4711";proto=https, for=10.0.0.2`,
+			"X-Forwarded-For": "192.0.2.1",
+		}, "2001:db8::1", IPSourceForwarded},
+		{"127.0.0.1:1234", map[string]string{"Forwarded": `for=192.0.2.1, for=unknown, for=10.0.0.2`}, "10.0.0.2", IPSourceForwarded},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		for k, v := range c.headers {
+			r.Header.Set(k, v)
+		}
+		ip, source := p.IP(r)
+		as.Equal(c.ip, ip.String(), "%s %v", c.remote, c.headers)
+		as.Equal(c.source, source, "%s %v", c.remote, c.headers)
+	}
+}
+
+func TestClientIPProxyProtocol(t *testing.T) {
+	as := assert.New(t)
+	trusted, _ := ParseCIDRs([]string{"127.0.0.1", "10.0.0.0/8"})
+	p := &Parser{TrustedProxies: trusted}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, source := p.IP(r)
+		io.WriteString(w, ip.String()+" "+source)
+	}))
+	srv.Listener = proxyproto.NewListener(srv.Listener, p.Trusted)
+	srv.Config.ConnContext = proxyproto.ConnContext
+	srv.Start()
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// a client inside the trusted CIDRs must not pick its IP with forwarding headers
+	io.WriteString(conn, "PROXY TCP4 10.0.0.5 198.51.100.1 56324 443\r\n"+
+		"GET / HTTP/1.1\r\nHost: test\r\nX-Forwarded-For: 192.0.2.1\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	as.Equal("10.0.0.5 "+IPSourceProxyProtocol, string(body))
+}
+
+func TestClientIPDefaultTrust(t *testing.T) {
+	as := assert.New(t)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "[::1]:1234"
+	r.Header.Set("X-Real-IP", "192.0.2.1")
+
+	ip, _ := (&Parser{}).IP(r)
+	as.Equal("192.0.2.1", ip.String())
+	ip, _ = (&Parser{TrustedProxies: []*net.IPNet{}}).IP(r)
+	as.Equal("::1", ip.String())
+}
+
+func TestScheme(t *testing.T) {
+	as := assert.New(t)
+	p := &Parser{}
+	cases := []struct {
+		remote, proto string
+		tls           bool
+		scheme        string
+	}{
+		{"192.0.2.1:1234", "", false, "http"},
+		{"192.0.2.1:1234", "", true, "https"},
+		{"127.0.0.1:1234", "", false, "https"},
+		{"127.0.0.1:1234", "http", false, "http"},
+		{"127.0.0.1:1234", "http", true, "http"},
+		// X-Forwarded-Proto from untrusted peers is ignored
+		{"192.0.2.1:1234", "http", true, "https"},
+		{"192.0.2.1:1234", "https", false, "http"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		if c.tls {
+			r = httptest.NewRequest("GET", "https://example.com/", nil)
+		}
+		r.RemoteAddr = c.remote
+		if c.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", c.proto)
+		}
+		as.Equal(c.scheme, p.Scheme(r), "%+v", c)
+	}
+}
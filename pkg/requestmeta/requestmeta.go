@@ -8,17 +8,23 @@ import (
 
 	"github.com/mirrorz-org/mirrorz-302/pkg/geo"
 	"github.com/mirrorz-org/mirrorz-302/pkg/logging"
+	"github.com/mirrorz-org/mirrorz-302/pkg/proxyproto"
 )
 
 type RequestMeta struct {
 	CName string
 	Tail  string
 
-	Scheme string
-	IP     net.IP
-	Region string
-	ISP    []string
-	Labels []string
+	Scheme   string
+	IP       net.IP
+	IPSource string // where IP was taken from, e.g. IPSourceRemote
+	Country  string // ISO 3166-1 alpha-2
+	Region   string
+	City     string
+	Point    *geo.Point // finest known position of the client, nil if unknown
+	ISP      []string
+	ASN      uint32
+	Labels   []string
 }
 
 const ApiPrefix = "/api/"
@@ -26,7 +32,9 @@ const ApiPrefix = "/api/"
 var parserLogger = logging.GetLogger("parser")
 
 type Parser struct {
-	DomainLength int
+	DomainLength   int
+	Geo            geo.Provider // nil for DefaultLocation
+	TrustedProxies []*net.IPNet // nil for DefaultTrustedProxies
 }
 
 // Parse parses a regular request and returns a RequestMeta.
@@ -39,17 +47,26 @@ func (p *Parser) Parse(r *http.Request) (meta RequestMeta) {
 
 func (p *Parser) parseCommon(r *http.Request, meta *RequestMeta) {
 	meta.Scheme = p.Scheme(r)
-	meta.IP = p.IP(r)
-	ipinfo, err := geo.Lookup(meta.IP.String())
+	meta.IP, meta.IPSource = p.IP(r)
+	loc := geo.DefaultLocation
+	var err error
+	if p.Geo != nil {
+		loc, err = p.Geo.Locate(meta.IP)
+	}
 	if err != nil {
 		parserLogger.Warningf("IPDB lookup failed for %s: %v\n", meta.IP, err)
 	} else {
-		meta.Region = geo.NameToCode(ipinfo.RegionName)
-		for _, line := range strings.Split(ipinfo.Line, "/") {
-			if isp := geo.ISPNameToCode(line); isp != "" {
-				meta.ISP = append(meta.ISP, isp)
-			}
+		meta.Country = loc.Country
+		meta.Region = loc.Region
+		meta.City = loc.City
+		if p, ok := loc.Position(); ok {
+			meta.Point = &p
 		}
+		meta.ISP = append(meta.ISP, loc.ISP...)
+		meta.ASN = loc.ASN
+	}
+	if meta.ASN == 0 {
+		meta.ASN = geo.LookupASN(meta.IP)
 	}
 }
 
@@ -64,7 +81,7 @@ func (m *RequestMeta) V6Only() bool {
 }
 
 func (m *RequestMeta) String() string {
-	return fmt.Sprintf("%s:%s (%v, %s/%s) %v", m.Scheme, m.CName, m.IP, m.Region, m.ISP, m.Labels)
+	return fmt.Sprintf("%s:%s (%v, %s/%s/%s, AS%d) %v", m.Scheme, m.CName, m.IP, m.Country, m.Region, m.ISP, m.ASN, m.Labels)
 }
 
 func (p *Parser) CNameAndTail(r *http.Request) (cname string, tail string) {
@@ -76,17 +93,22 @@ func (p *Parser) CNameAndTail(r *http.Request) (cname string, tail string) {
 	return
 }
 
+// Scheme returns the scheme of a request.
+//
+// X-Forwarded-Proto is used only if set by a trusted proxy, otherwise the connection decides.
+// Plain HTTP requests from trusted proxies without the header are assumed
+// to be HTTPS terminated by the proxy.
+// Behind the PROXY protocol, headers come from the client and are not trusted.
 func (p *Parser) Scheme(r *http.Request) (scheme string) {
-	scheme = r.Header.Get("X-Forwarded-Proto")
-	if scheme == "" {
-		scheme = "https"
+	ip := parseHost(r.RemoteAddr)
+	trusted := ip != nil && p.Trusted(ip) && !proxyproto.Proxied(r.Context())
+	if scheme = r.Header.Get("X-Forwarded-Proto"); scheme != "" && trusted {
+		return
 	}
-	return
-}
-
-func (p *Parser) IP(r *http.Request) (ip net.IP) {
-	ip = net.ParseIP(r.Header.Get("X-Real-IP"))
-	return
+	if r.TLS != nil || trusted {
+		return "https"
+	}
+	return "http"
 }
 
 func (p *Parser) Labels(r *http.Request) (labels []string) {
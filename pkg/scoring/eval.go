@@ -3,14 +3,18 @@ package scoring
 import (
 	"math"
 
-	"github.com/mirrorz-org/mirrorz-302/pkg/geo"
 	"github.com/mirrorz-org/mirrorz-302/pkg/mirrorzdb"
 	"github.com/mirrorz-org/mirrorz-302/pkg/requestmeta"
 )
 
 // Eval calculates the score for the endpoint with a given request.
 func Eval(e mirrorzdb.Endpoint, m requestmeta.RequestMeta) (score Score) {
-	for index, label := range m.Labels {
+	labels := m.Labels
+	if e.LabelConflict {
+		// the label belongs to another site, or to none
+		labels = nil
+	}
+	for index, label := range labels {
 		if label == e.Label {
 			score.Pos = index + 1
 			// Note: The last label takes precedence, so don't `break` here.
@@ -19,11 +23,17 @@ func Eval(e mirrorzdb.Endpoint, m requestmeta.RequestMeta) (score Score) {
 		}
 	}
 
+	if m.Country != "" && e.MatchCountry(m.Country) {
+		score.Country = 1
+	}
+
 	score.Geo = math.Inf(1)
-	for _, region := range e.RangeRegion {
-		d := geo.GeoDistance(m.Region, region)
-		if d < score.Geo {
-			score.Geo = d
+	if m.Point != nil {
+		for _, p := range e.Positions() {
+			d := m.Point.DistanceTo(p)
+			if d < score.Geo {
+				score.Geo = d
+			}
 		}
 	}
 
@@ -33,6 +43,10 @@ func Eval(e mirrorzdb.Endpoint, m requestmeta.RequestMeta) (score Score) {
 		}
 	}
 
+	if e.MatchASN(m.ASN) {
+		score.ASN = 1
+	}
+
 	if m.IP != nil {
 		score.Mask = e.MatchIPMask(m.IP)
 	}
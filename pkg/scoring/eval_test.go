@@ -0,0 +1,23 @@
+package scoring
+
+import (
+	"testing"
+
+	"github.com/mirrorz-org/mirrorz-302/pkg/mirrorzdb"
+	"github.com/mirrorz-org/mirrorz-302/pkg/requestmeta"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvalLabel(t *testing.T) {
+	as := assert.New(t)
+	e := mirrorzdb.Endpoint{Label: "tuna"}
+	m := requestmeta.RequestMeta{Labels: []string{"ustc", "tuna"}}
+	as.Equal(2, Eval(e, m).Pos)
+	m.Labels = []string{"avoidtuna"}
+	as.Equal(-1, Eval(e, m).Pos)
+
+	e.LabelConflict = true
+	as.Equal(0, Eval(e, m).Pos)
+	m.Labels = []string{"tuna"}
+	as.Equal(0, Eval(e, m).Pos)
+}
@@ -13,11 +13,13 @@ import (
 const JSONInfReplacement = 1e100
 
 type Score struct {
-	Pos   int     `json:"pos"`   // pos of label, bigger = better
-	Mask  int     `json:"mask"`  // longest mask
-	Geo   float64 `json:"geo"`   // geographical distance
-	ISP   int     `json:"isp"`   // matching ISP
-	Delta int     `json:"delta"` // often negative
+	Pos     int     `json:"pos"`     // pos of label, bigger = better
+	Mask    int     `json:"mask"`    // longest mask
+	ASN     int     `json:"asn"`     // matching AS
+	Country int     `json:"country"` // matching country
+	Geo     float64 `json:"geo"`     // geographical distance
+	ISP     int     `json:"isp"`     // matching ISP
+	Delta   int     `json:"delta"`   // often negative
 
 	// payload
 	Abbr    string `json:"abbr"`
@@ -38,6 +40,14 @@ func (l Score) Less(r Score) bool {
 	if l.Mask != r.Mask {
 		return l.Mask > r.Mask
 	}
+	// Interconnect within one AS is usually better than across AS
+	if l.ASN != r.ASN {
+		return l.ASN > r.ASN
+	}
+	// Endpoints in other countries are penalised
+	if l.Country != r.Country {
+		return l.Country > r.Country
+	}
 	// Favor ISP over raw geo distance
 	lGeo, rGeo := l.Geo, r.Geo
 	if l.ISP > 0 {
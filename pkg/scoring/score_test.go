@@ -56,3 +56,15 @@ func TestScoresJSON(t *testing.T) {
 	as.NotZero(b.Len())
 	as.Nil(err)
 }
+
+func TestScoreLessCountry(t *testing.T) {
+	as := assert.New(t)
+	home := Score{Country: 1, Geo: math.Inf(1)}
+	abroad := Score{Geo: 100}
+	as.True(home.Less(abroad))
+	as.False(abroad.Less(home))
+
+	// label position and CIDR still come first
+	abroad.Mask = 24
+	as.True(abroad.Less(home))
+}
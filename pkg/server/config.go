@@ -0,0 +1,162 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/mirrorz-org/mirrorz-302/pkg/geo"
+	"github.com/mirrorz-org/mirrorz-302/pkg/mirrorzdb"
+	"github.com/mirrorz-org/mirrorz-302/pkg/requestmeta"
+	"github.com/mirrorz-org/mirrorz-302/pkg/tlscert"
+)
+
+// Validate checks the config for mistakes that would otherwise only surface at runtime.
+// All problems are reported, each prefixed by its config key.
+func (c Config) Validate() error {
+	var errs []error
+	fail := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: "+format, append([]any{key}, args...)...))
+	}
+
+	switch c.StatusSource {
+	case "", "influxdb":
+		if c.InfluxDB.URL == "" {
+			fail("influxdb.url", "required by status-source influxdb")
+		} else if u, err := url.Parse(c.InfluxDB.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("influxdb.url", "%q is not an http(s) URL", c.InfluxDB.URL)
+		}
+		if c.InfluxDB.Org == "" {
+			fail("influxdb.org", "required by status-source influxdb")
+		}
+		if c.InfluxDB.Bucket == "" {
+			fail("influxdb.bucket", "required by status-source influxdb")
+		}
+	case "static":
+	case "snapshot":
+		if c.StatusFile == "" {
+			fail("status-file", "required by status-source snapshot")
+		}
+	default:
+		fail("status-source", "unknown source %q, want influxdb, static or snapshot", c.StatusSource)
+	}
+
+	for _, f := range []struct {
+		key   string
+		value int
+	}{
+		{"influxdb.lookback", c.InfluxDB.Lookback},
+		{"prefetch-interval", c.PrefetchInterval},
+		{"max-staleness", c.MaxStaleness},
+		{"max-age", c.MaxAge},
+		{"query-timeout", c.QueryTimeout},
+		{"breaker-threshold", c.BreakerThreshold},
+		{"breaker-cooldown", c.BreakerCooldown},
+		{"shutdown-timeout", c.ShutdownTimeout},
+		{"cache-time", c.CacheTime},
+		{"mirrorz-d-error-threshold", c.MirrorZDThreshold},
+	} {
+		if f.value < 0 {
+			fail(f.key, "must not be negative, got %d", f.value)
+		}
+	}
+	for _, status := range c.SkipStatus {
+		if len(status) != 1 || status[0] < 'A' || status[0] > 'Z' {
+			fail("skip-status", "%q is not a mirrorz status letter", status)
+		}
+	}
+
+	if _, err := geo.NewProvider(c.GeoProvider); err != nil {
+		fail("geo-provider", "%v", err)
+	}
+
+	for _, f := range []struct{ key, addr string }{
+		{"http-bind-address", c.HTTPBindAddress},
+		{"https-bind-address", c.HTTPSBindAddress},
+	} {
+		if f.addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(f.addr); err != nil {
+			fail(f.key, "%v", err)
+		}
+	}
+	if c.HTTPSBindAddress != "" {
+		if c.TLSCertFile == "" {
+			fail("tls-cert-file", "required by https-bind-address")
+		}
+		if c.TLSKeyFile == "" {
+			fail("tls-key-file", "required by https-bind-address")
+		}
+	}
+	if _, err := requestmeta.ParseCIDRs(c.TrustedProxies); err != nil {
+		fail("trusted-proxies", "%v", err)
+	}
+
+	if c.MirrorZDDirectory == "" {
+		fail("mirrorz-d-directory", "required")
+	}
+	if _, ok := mirrorzdb.ParseConflictPolicy(c.LabelConflict); !ok {
+		fail("label-conflict", "unknown policy %q, want first-wins, reject or namespace", c.LabelConflict)
+	}
+	if c.Homepage == "" {
+		fail("homepage", "required")
+	} else if strings.Contains(c.Homepage, "://") {
+		fail("homepage", "%q must not include a scheme", c.Homepage)
+	}
+	if c.DomainLength <= 0 {
+		fail("domain-length", "must be positive, got %d", c.DomainLength)
+	}
+	return errors.Join(errs...)
+}
+
+// Check validates the config and loads the files it refers to, without starting a server.
+// The geo tables and ISP catalogue of package geo are replaced as a side effect.
+func Check(config Config) error {
+	errs := []error{config.Validate()}
+	load := func(key, file string, load func(string) error) {
+		if file == "" {
+			return
+		}
+		if fi, err := os.Stat(file); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		} else if !fi.Mode().IsRegular() {
+			errs = append(errs, fmt.Errorf("%s: %s is not a regular file", key, file))
+		} else if err := load(file); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+
+	load("asn-db-file", config.ASNDBFile, geo.LoadASNDB)
+	load("geo-table-file", config.GeoTableFile, geo.LoadGeoTable)
+	load("isp-file", config.ISPFile, geo.LoadISPCatalogue)
+	if provider, err := geo.NewProvider(config.GeoProvider); err == nil {
+		if _, ok := provider.(*geo.MMDB); ok {
+			load("mmdb-file", config.MMDBFile, provider.Load)
+		} else {
+			load("ipdb-file", config.IPDBFile, provider.Load)
+		}
+	}
+	if config.StatusSource == "static" || config.StatusSource == "snapshot" {
+		load("status-file", config.StatusFile, func(string) error {
+			set := &settings{statusFile: config.StatusFile}
+			buildStatusSource(set, config)
+			return loadStatus(set)
+		})
+	}
+	if config.TLSCertFile != "" && config.TLSKeyFile != "" {
+		load("tls-key-file", config.TLSKeyFile, func(string) error { return nil })
+		load("tls-cert-file", config.TLSCertFile, func(string) error {
+			return tlscert.NewStore(config.TLSCertFile, config.TLSKeyFile).Load()
+		})
+	}
+	if config.MirrorZDDirectory != "" {
+		if err := mirrorzdb.Check(config.MirrorZDDirectory); err != nil {
+			errs = append(errs, fmt.Errorf("mirrorz-d-directory: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
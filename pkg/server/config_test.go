@@ -0,0 +1,77 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/goccy/go-yaml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateExample(t *testing.T) {
+	content, err := os.ReadFile("../../etc/mirrorzd.example.yaml")
+	require.Nil(t, err)
+	var config Config
+	require.Nil(t, yaml.UnmarshalWithOptions(content, &config, yaml.Strict()))
+	assert.Nil(t, config.Validate())
+}
+
+func TestValidate(t *testing.T) {
+	as := assert.New(t)
+	config := Config{
+		StatusSource:      "snapshot",
+		MaxAge:            -1,
+		SkipStatus:        []string{"F", "fail"},
+		GeoProvider:       "geoip",
+		HTTPSBindAddress:  "443",
+		TrustedProxies:    []string{"10.0.0.0/33"},
+		MirrorZDDirectory: "mirrorz.d",
+		Homepage:          "https://mirrorz.org",
+	}
+	err := config.Validate()
+	if as.NotNil(err) {
+		for _, key := range []string{
+			"status-file", "max-age", "skip-status", "geo-provider", "https-bind-address",
+			"tls-cert-file", "tls-key-file", "trusted-proxies", "homepage", "domain-length",
+		} {
+			as.Contains(err.Error(), key+": ")
+		}
+		as.NotContains(err.Error(), "influxdb")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	as := assert.New(t)
+	dir := t.TempDir()
+	as.Nil(os.WriteFile(filepath.Join(dir, "test.json"), []byte(testMirrorZD), 0644))
+	as.Nil(os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0644))
+
+	config := Config{
+		StatusSource:      "static",
+		IPDBFile:          "/dev/null",
+		MirrorZDDirectory: dir,
+		Homepage:          "mirrorz.org",
+		DomainLength:      5,
+	}
+	err := Check(config)
+	if as.NotNil(err) {
+		as.Contains(err.Error(), "ipdb-file: /dev/null is not a regular file")
+		as.Contains(err.Error(), "mirrorz-d-directory: broken.json: ")
+		as.NotContains(err.Error(), "test.json")
+	}
+	config.IPDBFile = ""
+	as.Nil(os.Remove(filepath.Join(dir, "broken.json")))
+	as.Nil(Check(config))
+}
+
+func TestNewServerInvalid(t *testing.T) {
+	as := assert.New(t)
+	_, err := NewServer(Config{GeoProvider: "geoip"})
+	as.ErrorContains(err, "geo-provider")
+	_, err = NewServer(Config{TrustedProxies: []string{"10.0.0.0/33"}})
+	as.ErrorContains(err, "trusted-proxies")
+	_, err = NewServer(Config{LabelConflict: "last-wins"})
+	as.ErrorContains(err, "label-conflict")
+}
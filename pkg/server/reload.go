@@ -0,0 +1,228 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mirrorz-org/mirrorz-302/pkg/influxdb"
+	"github.com/mirrorz-org/mirrorz-302/pkg/mirrorzdb"
+	"github.com/mirrorz-org/mirrorz-302/pkg/requestmeta"
+)
+
+// settings are the parts of the configuration used while serving requests.
+// They are replaced as a whole by ApplyConfig and never modified in place.
+type settings struct {
+	meta *requestmeta.Parser
+
+	status     influxdb.MirrorStatusSource
+	statusBase influxdb.MirrorStatusSource // status before wrapping
+	prefetch   *influxdb.PrefetchSource
+	statusFile string
+
+	mirrorzdDir       string
+	mirrorzdThreshold int
+	labelConflict     mirrorzdb.ConflictPolicy
+	logDir            string
+	homepage          string
+	maxAge            time.Duration
+	skipStatus        []string
+}
+
+// settings returns the current settings.
+func (s *Server) settings() *settings {
+	return s.cur.Load()
+}
+
+// statusFields are the config fields used to build the status source.
+var statusFields = []string{
+	"influxdb", "status-source", "status-file", "prefetch-interval",
+	"max-staleness", "query-timeout", "breaker-threshold", "breaker-cooldown",
+}
+
+// coldFields are the config fields only applied at startup.
+var coldFields = []string{
+	"geo-provider", "ipdb-file", "mmdb-file", "asn-db-file", "geo-table-file", "isp-file",
+	"http-bind-address", "https-bind-address", "tls-cert-file", "tls-key-file",
+	"proxy-protocol", "shutdown-timeout", "watch-files",
+}
+
+// changedFields returns the names of the fields in names that differ between a and b.
+func changedFields(a, b Config, names []string) (changed []string) {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for _, name := range names {
+		for i := 0; i < va.NumField(); i++ {
+			tag, _, _ := strings.Cut(va.Type().Field(i).Tag.Get("json"), ",")
+			if tag == name && !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+				changed = append(changed, name)
+			}
+		}
+	}
+	return
+}
+
+// newSettings builds the settings for config.
+// The status source of old is reused if its config did not change.
+func (s *Server) newSettings(config Config, old *settings) (*settings, error) {
+	set := &settings{
+		meta: &requestmeta.Parser{
+			DomainLength: config.DomainLength,
+			Geo:          s.geo,
+		},
+		statusFile:        config.StatusFile,
+		mirrorzdDir:       config.MirrorZDDirectory,
+		mirrorzdThreshold: config.MirrorZDThreshold,
+		logDir:            config.LogDirectory,
+		homepage:          config.Homepage,
+		maxAge:            time.Duration(config.MaxAge) * time.Second,
+		skipStatus:        config.SkipStatus,
+	}
+	if set.skipStatus == nil {
+		set.skipStatus = DefaultSkipStatus
+	}
+	policy, ok := mirrorzdb.ParseConflictPolicy(config.LabelConflict)
+	if !ok {
+		return nil, fmt.Errorf("label-conflict: unknown policy %q", config.LabelConflict)
+	}
+	set.labelConflict = policy
+	if config.TrustedProxies != nil {
+		trusted, err := requestmeta.ParseCIDRs(config.TrustedProxies)
+		if err != nil {
+			return nil, fmt.Errorf("trusted-proxies: %w", err)
+		}
+		set.meta.TrustedProxies = trusted
+	}
+	if old != nil && len(changedFields(s.config, config, statusFields)) == 0 {
+		set.status, set.statusBase, set.prefetch = old.status, old.statusBase, old.prefetch
+	} else {
+		buildStatusSource(set, config)
+	}
+	return set, nil
+}
+
+// closeSource closes a status source that holds resources, e.g. an InfluxDB client.
+func closeSource(src influxdb.MirrorStatusSource) {
+	if c, ok := src.(interface{ Close() }); ok {
+		c.Close()
+	}
+}
+
+// retireDelay is how long a replaced status source is kept open for in-flight queries.
+const retireDelay = time.Minute
+
+// retiredSource is a replaced status source waiting to be closed.
+type retiredSource struct {
+	src   influxdb.MirrorStatusSource
+	timer *time.Timer
+}
+
+// retire closes src after retireDelay, or on Shutdown if that comes first.
+// It must be called with applyMu held.
+func (s *Server) retire(src influxdb.MirrorStatusSource) {
+	r := &retiredSource{src: src}
+	r.timer = time.AfterFunc(retireDelay, func() {
+		s.applyMu.Lock()
+		defer s.applyMu.Unlock()
+		n := len(s.retired)
+		s.retired = slices.DeleteFunc(s.retired, func(x *retiredSource) bool { return x == r })
+		// otherwise closed by closeRetired already
+		if len(s.retired) < n {
+			closeSource(r.src)
+		}
+	})
+	s.retired = append(s.retired, r)
+}
+
+// closeRetired closes the replaced status sources now, without waiting for retireDelay.
+func (s *Server) closeRetired() {
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+	for _, r := range s.retired {
+		r.timer.Stop()
+		closeSource(r.src)
+	}
+	s.retired = nil
+}
+
+// ApplyConfig replaces the running configuration.
+//
+// Everything is prepared first, including loading the new status source
+// and log directory, so that on error the running configuration is kept.
+// It returns the changed fields that only take effect after a restart.
+func (s *Server) ApplyConfig(config Config) (notApplied []string, err error) {
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+
+	old := s.settings()
+	set, err := s.newSettings(config, old)
+	if err != nil {
+		return nil, err
+	}
+	newSource := set.statusBase != old.statusBase
+	abort := func(err error) ([]string, error) {
+		if newSource {
+			closeSource(set.statusBase)
+		}
+		return nil, err
+	}
+
+	if newSource {
+		if err := loadStatus(set); err != nil {
+			return abort(fmt.Errorf("status source: %w", err))
+		}
+	}
+	if set.logDir != old.logDir {
+		if err := initLoggers(set.logDir); err != nil {
+			initLoggers(old.logDir)
+			return abort(fmt.Errorf("log-directory: %w", err))
+		}
+	}
+	s.mirrorzd.SetErrorThreshold(set.mirrorzdThreshold)
+	if set.mirrorzdDir != old.mirrorzdDir || set.labelConflict != old.labelConflict {
+		s.mirrorzd.SetConflictPolicy(set.labelConflict)
+		if err := s.mirrorzd.Load(set.mirrorzdDir); err != nil {
+			s.mirrorzd.SetConflictPolicy(old.labelConflict)
+			s.mirrorzd.SetErrorThreshold(old.mirrorzdThreshold)
+			if set.logDir != old.logDir {
+				initLoggers(old.logDir)
+			}
+			return abort(fmt.Errorf("mirrorz-d-directory: %w", err))
+		}
+	}
+
+	s.cur.Store(set)
+	if s.mirrorzdWatcher != nil && set.mirrorzdDir != old.mirrorzdDir {
+		if err := s.watchMirrorZD(set.mirrorzdDir); err != nil {
+			s.errorLogger.Errorf("Error watching mirrorz.d: %v\n", err)
+		}
+	}
+	if ttl := time.Duration(config.CacheTime) * time.Second; ttl != s.resolved.TTL() {
+		s.resolved.SetTTL(ttl)
+	}
+	if newSource {
+		if s.prefetching && set.prefetch != nil {
+			set.prefetch.Start()
+		}
+		if old.prefetch != nil {
+			old.prefetch.Stop()
+		}
+		s.retire(old.statusBase)
+	}
+
+	notApplied = changedFields(s.config, config, coldFields)
+	s.config = config
+	return notApplied, nil
+}
+
+// StartPrefetch starts refreshing the status table in the background, if enabled.
+// Status sources replaced by ApplyConfig are started as well.
+func (s *Server) StartPrefetch() {
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+	s.prefetching = true
+	if set := s.settings(); set.prefetch != nil {
+		set.prefetch.Start()
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mirrorz-org/mirrorz-302/pkg/influxdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyConfig(t *testing.T) {
+	as := assert.New(t)
+	s, src := newTestServer(t)
+
+	config := s.config
+	config.Homepage = "https://example.com/"
+	config.MaxAge = 600
+	config.CacheTime = 60
+	config.HTTPBindAddress = "localhost:8080"
+	notApplied, err := s.ApplyConfig(config)
+	as.Nil(err)
+	as.Equal([]string{"http-bind-address"}, notApplied)
+	as.Equal("https://example.com/", s.settings().homepage)
+	as.Equal(10*time.Minute, s.settings().maxAge)
+	as.Equal(time.Minute, s.resolved.TTL())
+	// the status source is kept when its config is unchanged
+	as.Equal(src, s.settings().statusBase)
+
+	// an invalid config keeps the current one
+	bad := config
+	bad.Homepage = "https://example.org/"
+	bad.TrustedProxies = []string{"not-an-ip"}
+	_, err = s.ApplyConfig(bad)
+	as.NotNil(err)
+	bad.TrustedProxies = nil
+	bad.StatusFile = filepath.Join(t.TempDir(), "missing.json")
+	_, err = s.ApplyConfig(bad)
+	as.NotNil(err)
+	as.Equal("https://example.com/", s.settings().homepage)
+	as.Equal(src, s.settings().statusBase)
+}
+
+// closingSource is a StaticSource counting calls to Close.
+type closingSource struct {
+	*influxdb.StaticSource
+	closed int
+}
+
+func (c *closingSource) Close() { c.closed++ }
+
+func TestApplyConfigRetire(t *testing.T) {
+	as := assert.New(t)
+	s, _ := newTestServer(t)
+	old := &closingSource{StaticSource: influxdb.NewStaticSource(nil)}
+	modify(s, func(set *settings) { set.statusBase = old })
+
+	config := s.config
+	config.BreakerThreshold = 3
+	_, err := s.ApplyConfig(config)
+	as.Nil(err)
+	as.NotEqual(old, s.settings().statusBase)
+	as.Equal(0, old.closed, "a replaced source should be kept open for in-flight queries")
+	as.Len(s.retired, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	as.Nil(s.Shutdown(ctx))
+	as.Equal(1, old.closed, "Shutdown should close replaced sources")
+	as.Empty(s.retired)
+}
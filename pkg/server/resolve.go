@@ -2,27 +2,126 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/mirrorz-org/mirrorz-302/pkg/caching"
 	"github.com/mirrorz-org/mirrorz-302/pkg/influxdb"
+	"github.com/mirrorz-org/mirrorz-302/pkg/mirrorzdb"
 	"github.com/mirrorz-org/mirrorz-302/pkg/requestmeta"
 	"github.com/mirrorz-org/mirrorz-302/pkg/scoring"
 	"github.com/mirrorz-org/mirrorz-302/pkg/tracing"
 )
 
-func (s *Server) queryInflux(ctx context.Context, cname string) (res influxdb.Result, ok bool) {
-	res, err := s.influx.Query(ctx, cname)
-	if res == nil {
+// resultOrigin tells where a status result comes from.
+type resultOrigin int
+
+const (
+	originLive     resultOrigin = iota // fresh from the status source
+	originStale                        // remembered result served during an outage
+	originMirrorZD                     // built from mirrorz.d only, no freshness data
+)
+
+// queryInflux queries the status source for cname.
+//
+// While the circuit breaker is open and no stale result is available,
+// the mirrors listed in mirrorz.d are returned without freshness data.
+func (s *Server) queryInflux(ctx context.Context, cname string) (res influxdb.Result, origin resultOrigin, ok bool) {
+	tracer := ctx.Value(tracing.Key).(tracing.Tracer)
+	// only query cnames known to mirrorz.d
+	if _, ok := s.mirrorzd.Query(mirrorzdb.NormalizeCname(cname)); !ok {
+		tracer.Printf("Unknown cname: %q\n", cname)
+		return make(influxdb.Result, 0), originLive, true
+	}
+	res, err := s.settings().status.Query(ctx, cname)
+	var staleErr *influxdb.StaleError
+	if res == nil && errors.Is(err, influxdb.ErrCircuitOpen) {
+		tracer.Printf("Status source unavailable, using mirrorz.d only\n")
+		return s.dropSkipped(ctx, cname, s.queryMirrorZD(cname)), originMirrorZD, true
+	} else if res == nil {
 		s.errorLogger.Errorf("Resolve query failed: %v\n", err)
-		return res, false
+		return res, originLive, false
+	} else if errors.As(err, &staleErr) {
+		s.errorLogger.Warningf("Resolve query failed for %s: %v\n", cname, err)
+		tracer.Printf("Stale: %s old\n", staleErr.Age.Round(time.Second))
+		origin = originStale
 	} else if err != nil {
 		s.errorLogger.Warningf("Resolve query error: %v\n", err)
 		// result available, continuing anyway
 	}
-	return res, true
+	if origin == originLive {
+		res = s.dropOutdated(ctx, res)
+	}
+	return s.dropSkipped(ctx, cname, res), origin, true
+}
+
+// dropSkipped removes items whose mirror for cname is disabled
+// or has a skipped status in mirrorz.d.
+func (s *Server) dropSkipped(ctx context.Context, cname string, res influxdb.Result) influxdb.Result {
+	tracer := ctx.Value(tracing.Key).(tracing.Tracer)
+	cname = mirrorzdb.NormalizeCname(cname)
+	kept := res[:0:0]
+	for _, item := range res {
+		if reason, skip := s.mirrorSkipped(cname, item.Mirror); skip {
+			tracer.Printf("skip %s: %s\n", item.Mirror, reason)
+			continue
+		}
+		kept = append(kept, item)
+	}
+	return kept
+}
+
+// mirrorSkipped reports whether the mirror of a site for a normalized cname
+// is disabled or has a skipped status in mirrorz.d.
+func (s *Server) mirrorSkipped(cname, abbr string) (reason string, skip bool) {
+	mirror, ok := s.mirrorzd.Mirror(cname, abbr)
+	if !ok {
+		return
+	}
+	if mirror.Disable {
+		return "disabled in mirrorz.d", true
+	}
+	code := mirrorzdb.StatusCode(mirror.Status)
+	for _, c := range s.settings().skipStatus {
+		if code != "" && strings.EqualFold(code, c) {
+			return fmt.Sprintf("status %s in mirrorz.d", mirror.Status), true
+		}
+	}
+	return
+}
+
+// dropOutdated removes items whose last report is older than max-age.
+func (s *Server) dropOutdated(ctx context.Context, res influxdb.Result) influxdb.Result {
+	maxAge := s.settings().maxAge
+	if maxAge <= 0 {
+		return res
+	}
+	tracer := ctx.Value(tracing.Key).(tracing.Tracer)
+	now := time.Now()
+	kept := res[:0:0]
+	for _, item := range res {
+		if age := now.Sub(item.Time); !item.Time.IsZero() && age > maxAge {
+			tracer.Printf("drop %s: last report %s ago exceeds max-age %s\n",
+				item.Mirror, age.Round(time.Second), maxAge)
+			continue
+		}
+		kept = append(kept, item)
+	}
+	return kept
+}
+
+// queryMirrorZD builds a result from the mirrors declared in mirrorz.d for cname.
+func (s *Server) queryMirrorZD(cname string) influxdb.Result {
+	mirrors, _ := s.mirrorzd.Query(mirrorzdb.NormalizeCname(cname))
+	res := make(influxdb.Result, 0, len(mirrors))
+	for _, mirror := range mirrors {
+		res = append(res, influxdb.Item{Mirror: mirror.Abbr, Path: mirror.Path})
+	}
+	return res
 }
 
 func (s *Server) Resolve(ctx context.Context, meta requestmeta.RequestMeta) (url string, err error) {
@@ -30,22 +129,28 @@ func (s *Server) Resolve(ctx context.Context, meta requestmeta.RequestMeta) (url
 
 	cname := meta.CName
 	tracer.Printf("Labels: %v\n", meta.Labels)
-	tracer.Printf("IP: %s\n", meta.IP)
+	tracer.Printf("IP: %s (from %s)\n", meta.IP, meta.IPSource)
+	tracer.Printf("Country: %s\n", meta.Country)
+	if meta.Point != nil {
+		tracer.Printf("Position: %s %.4f,%.4f\n", meta.City, meta.Point.Latitude, meta.Point.Longitude)
+	}
+	tracer.Printf("ASN: %d\n", meta.ASN)
 	tracer.Printf("Scheme: %s\n", meta.Scheme)
 
+	// meta is logged as &meta so that (*RequestMeta).String formats it, including the ASN
 	logFunc := func(url string, score scoring.Score, char string) {
 		if url != "" {
 			// record detail in resolve log
 			s.resolveLogger.Debugf("%s", tracer.String())
 			resolvedLog := fmt.Sprintf("%s: %s %s %s",
-				char, url, meta,
+				char, url, &meta,
 				score)
 			s.resolveLogger.Infof("%s\n", resolvedLog)
 			tracer.Printf("%s\n", resolvedLog)
 		} else {
 			// record detail in fail log
 			s.failLogger.Debugf("%s", tracer.String())
-			failLog := fmt.Sprintf("F: %s", meta)
+			failLog := fmt.Sprintf("F: %s", &meta)
 			s.failLogger.Infof("%s\n", failLog)
 			tracer.Printf("%s\n", failLog)
 		}
@@ -64,7 +169,7 @@ func (s *Server) Resolve(ctx context.Context, meta requestmeta.RequestMeta) (url
 		return
 	}
 
-	res, ok := s.queryInflux(ctx, cname)
+	res, origin, ok := s.queryInflux(ctx, cname)
 	if !ok {
 		return "", fmt.Errorf("queryInflux failed")
 	}
@@ -97,7 +202,14 @@ func (s *Server) Resolve(ctx context.Context, meta requestmeta.RequestMeta) (url
 		Url:     url,
 		Resolve: resolve,
 	})
-	logFunc(url, chosenScore, "R") // R for resolve
+	switch origin {
+	case originStale:
+		logFunc(url, chosenScore, "S") // S for stale
+	case originMirrorZD:
+		logFunc(url, chosenScore, "M") // M for mirrorz.d only
+	default:
+		logFunc(url, chosenScore, "R") // R for resolve
+	}
 	return
 }
 
@@ -124,22 +236,72 @@ func (s *Server) ResolveBest(ctx context.Context, meta requestmeta.RequestMeta)
 	if meta.CName == "" {
 		return s.resolveBestAll(ctx, meta)
 	}
-	res, ok := s.queryInflux(ctx, meta.CName)
+	res, _, ok := s.queryInflux(ctx, meta.CName)
 	if !ok {
 		return
 	}
 	return s.resolveBest(ctx, res, meta, 0)
 }
 
+// resolveBestAll scores all sites regardless of cname.
+//
+// The Delta of a site is the median of its Deltas over all cnames,
+// fetched in one batch and filtered like the result of queryInflux.
+// Sites without any Delta are left out.
 func (s *Server) resolveBestAll(ctx context.Context, meta requestmeta.RequestMeta) (scores scoring.Scores) {
+	values := make(map[string][]int)
+	m, origin := s.queryMatrix(ctx, s.mirrorzd.CNames())
+	for cname, res := range m {
+		if origin == originLive {
+			res = s.dropOutdated(ctx, res)
+		}
+		for _, item := range s.dropSkipped(ctx, cname, res) {
+			values[item.Mirror] = append(values[item.Mirror], item.Value)
+		}
+	}
+
 	res := make(influxdb.Result, 0)
 	for _, file := range s.mirrorzd.Files() {
 		abbr := file.Site.Abbr
-		res = append(res, influxdb.Item{Mirror: abbr})
+		if value, ok := median(values[abbr]); ok {
+			res = append(res, influxdb.Item{Mirror: abbr, Value: value})
+		}
 	}
 	return s.resolveBest(ctx, res, meta, 1)
 }
 
+// queryMatrix fetches the status of many cnames in one batch.
+//
+// On failure, the error is logged and a nil map is returned.
+// The origin is originStale if the status source returned remembered results.
+func (s *Server) queryMatrix(ctx context.Context, cnames []string) (m map[string]influxdb.Result, origin resultOrigin) {
+	m, err := influxdb.QueryMany(ctx, s.settings().status, cnames)
+	var staleErr *influxdb.StaleError
+	if m == nil {
+		s.errorLogger.Errorf("Batch query failed: %v\n", err)
+	} else if errors.As(err, &staleErr) {
+		s.errorLogger.Warningf("Batch query failed: %v\n", err)
+		origin = originStale
+	} else if err != nil {
+		s.errorLogger.Warningf("Batch query error: %v\n", err)
+	}
+	return
+}
+
+// median returns the median of values, or false if there is none.
+func median(values []int) (int, bool) {
+	if len(values) == 0 {
+		return 0, false
+	}
+	sorted := append([]int(nil), values...)
+	sort.Ints(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2], true
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2, true
+}
+
 // Resolves the best mirror for the given request.
 func (s *Server) resolveBest(ctx context.Context, res influxdb.Result, meta requestmeta.RequestMeta, mode int) (scores scoring.Scores) {
 	tracer := ctx.Value(tracing.Key).(tracing.Tracer)
@@ -1,10 +1,19 @@
 package server
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/mirrorz-org/mirrorz-302/pkg/influxdb"
+	"github.com/mirrorz-org/mirrorz-302/pkg/requestmeta"
+	"github.com/mirrorz-org/mirrorz-302/pkg/tracing"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCalcDeltaCutoff(t *testing.T) {
@@ -18,3 +27,201 @@ func TestCalcDeltaCutoff(t *testing.T) {
 	// avg = -2, std = 3, zero and positive values are ignored
 	as.Equal(-8, calcDeltaCutoff(payload))
 }
+
+const testMirrorZD = `{
+  "extension": "D",
+  "endpoints": [
+    {
+      "label": "test",
+      "public": true,
+      "resolve": "mirrors.example.edu.cn",
+      "filter": ["V4", "V6", "SSL", "NOSSL"],
+      "range": ["REGION:BJ"]
+    }
+  ],
+  "site": {"abbr": "TEST"},
+  "mirrors": [{"cname": "debian", "url": "/debian"}]
+}`
+
+// newTestServer returns a Server backed by a StaticSource,
+// with the test site and any extra mirrorz.d.json files.
+func newTestServer(t *testing.T, extra ...string) (*Server, *influxdb.StaticSource) {
+	t.Helper()
+	dir := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "test.json"), []byte(testMirrorZD), 0644))
+	for i, content := range extra {
+		name := filepath.Join(dir, fmt.Sprintf("extra%d.json", i))
+		require.Nil(t, os.WriteFile(name, []byte(content), 0644))
+	}
+
+	s, err := NewServer(Config{
+		StatusSource:      "static",
+		MirrorZDDirectory: dir,
+		CacheTime:         300,
+	})
+	require.Nil(t, err)
+	require.Nil(t, s.LoadMirrorZD())
+	src := s.settings().statusBase.(*influxdb.StaticSource)
+	return s, src
+}
+
+// testSite returns a mirrorz.d.json of a site with a single endpoint, labelled abbr,
+// and a single mirror.
+func testSite(abbr, mirror string) string {
+	return fmt.Sprintf(`{
+  "endpoints": [{"label": "%s", "public": true, "resolve": "%s.example.edu.cn", "filter": ["V4", "SSL"]}],
+  "site": {"abbr": "%s"},
+  "mirrors": [%s]
+}`, abbr, abbr, abbr, mirror)
+}
+
+// modify replaces the settings of s with a modified copy.
+func modify(s *Server, f func(set *settings)) {
+	set := *s.settings()
+	f(&set)
+	s.cur.Store(&set)
+}
+
+func testContext() context.Context {
+	return context.WithValue(context.Background(), tracing.Key, tracing.NewTracer(true))
+}
+
+func TestResolveStatic(t *testing.T) {
+	as := assert.New(t)
+	s, src := newTestServer(t)
+	src.Store("debian", influxdb.Result{{Mirror: "TEST", Value: -10, Path: "/debian"}})
+
+	meta := requestmeta.RequestMeta{
+		CName:  "debian",
+		Scheme: "https",
+		IP:     net.ParseIP("192.0.2.1"),
+	}
+	url, err := s.Resolve(testContext(), meta)
+	as.Nil(err)
+	as.Equal("https://mirrors.example.edu.cn/debian", url)
+
+	meta.CName = "ubuntu"
+	url, err = s.Resolve(testContext(), meta)
+	as.Nil(err)
+	as.Equal("", url)
+}
+
+// openSource behaves like a status source behind an open circuit breaker.
+type openSource struct{}
+
+func (openSource) Query(ctx context.Context, cname string) (influxdb.Result, error) {
+	return nil, influxdb.ErrCircuitOpen
+}
+
+func TestResolveCircuitOpen(t *testing.T) {
+	as := assert.New(t)
+	s, _ := newTestServer(t)
+	modify(s, func(set *settings) { set.status = openSource{} })
+
+	meta := requestmeta.RequestMeta{
+		CName:  "debian",
+		Scheme: "http",
+		IP:     net.ParseIP("2001:db8::1"),
+	}
+	url, err := s.Resolve(testContext(), meta)
+	as.Nil(err)
+	as.Equal("http://mirrors.example.edu.cn/debian", url)
+}
+
+// recordingSource records every cname queried.
+type recordingSource struct {
+	cnames []string
+}
+
+func (r *recordingSource) Query(ctx context.Context, cname string) (influxdb.Result, error) {
+	r.cnames = append(r.cnames, cname)
+	return make(influxdb.Result, 0), nil
+}
+
+func TestResolveUnknownCName(t *testing.T) {
+	as := assert.New(t)
+	s, _ := newTestServer(t)
+	src := new(recordingSource)
+	modify(s, func(set *settings) { set.status = src })
+
+	for _, cname := range []string{`") |> drop() //`, `${r}`, "deb\nian", "ubuntu"} {
+		meta := requestmeta.RequestMeta{CName: cname, Scheme: "https", IP: net.ParseIP("192.0.2.1")}
+		url, err := s.Resolve(testContext(), meta)
+		as.Nil(err)
+		as.Equal("", url)
+	}
+	as.Empty(src.cnames)
+
+	meta := requestmeta.RequestMeta{CName: "debian", Scheme: "https", IP: net.ParseIP("192.0.2.1")}
+	s.Resolve(testContext(), meta)
+	as.Equal([]string{"debian"}, src.cnames)
+}
+
+func TestResolveMaxAge(t *testing.T) {
+	as := assert.New(t)
+	s, src := newTestServer(t)
+	modify(s, func(set *settings) { set.maxAge = 10 * time.Minute })
+	meta := requestmeta.RequestMeta{CName: "debian", Scheme: "https", IP: net.ParseIP("192.0.2.1")}
+
+	src.Store("debian", influxdb.Result{{Mirror: "TEST", Path: "/debian", Time: time.Now().Add(-time.Hour)}})
+	ctx := testContext()
+	url, err := s.Resolve(ctx, meta)
+	as.Nil(err)
+	as.Equal("", url)
+	as.Contains(ctx.Value(tracing.Key).(tracing.Tracer).String(), "exceeds max-age")
+
+	s.CachePurge()
+	src.Store("debian", influxdb.Result{{Mirror: "TEST", Path: "/debian", Time: time.Now().Add(-time.Minute)}})
+	url, err = s.Resolve(testContext(), meta)
+	as.Nil(err)
+	as.Equal("https://mirrors.example.edu.cn/debian", url)
+}
+
+func TestResolveSkipStatus(t *testing.T) {
+	as := assert.New(t)
+	s, src := newTestServer(t,
+		testSite("disabled", `{"cname": "debian", "url": "/debian", "disable": true}`),
+		testSite("failed", `{"cname": "debian", "url": "/debian", "status": "F1624546695X1624553695"}`),
+	)
+	src.Store("debian", influxdb.Result{
+		{Mirror: "disabled", Value: 0, Path: "/debian"},
+		{Mirror: "failed", Value: 0, Path: "/debian"},
+		{Mirror: "TEST", Value: -100, Path: "/debian"},
+	})
+
+	meta := requestmeta.RequestMeta{CName: "debian", Scheme: "https", IP: net.ParseIP("192.0.2.1")}
+	ctx := testContext()
+	scores := s.ResolveBest(ctx, meta)
+	if as.Len(scores, 1) {
+		as.Equal("TEST", scores[0].Abbr)
+	}
+	trace := ctx.Value(tracing.Key).(tracing.Tracer).String()
+	as.Contains(trace, "skip disabled: disabled in mirrorz.d")
+	as.Contains(trace, "skip failed: status F1624546695X1624553695 in mirrorz.d")
+
+	modify(s, func(set *settings) { set.skipStatus = nil })
+	scores = s.ResolveBest(testContext(), meta)
+	as.Len(scores, 2)
+}
+
+func TestResolveBestAllFiltered(t *testing.T) {
+	as := assert.New(t)
+	s, src := newTestServer(t,
+		testSite("disabled", `{"cname": "debian", "url": "/debian", "disable": true}`),
+		testSite("outdated", `{"cname": "debian", "url": "/debian"}`),
+		testSite("nodata", `{"cname": "debian", "url": "/debian"}`),
+	)
+	modify(s, func(set *settings) { set.maxAge = 10 * time.Minute })
+	src.Store("debian", influxdb.Result{
+		{Mirror: "disabled", Value: 0, Path: "/debian"},
+		{Mirror: "outdated", Value: 0, Path: "/debian", Time: time.Now().Add(-time.Hour)},
+		{Mirror: "TEST", Value: -100, Path: "/debian", Time: time.Now()},
+	})
+
+	meta := requestmeta.RequestMeta{Scheme: "https", IP: net.ParseIP("192.0.2.1")}
+	scores := s.ResolveBest(testContext(), meta)
+	if as.Len(scores, 1) {
+		as.Equal("TEST", scores[0].Abbr)
+		as.Equal(-100, scores[0].Delta)
+	}
+}
@@ -2,45 +2,101 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/juju/loggo"
 	"github.com/mirrorz-org/mirrorz-302/pkg/caching"
+	"github.com/mirrorz-org/mirrorz-302/pkg/geo"
 	"github.com/mirrorz-org/mirrorz-302/pkg/influxdb"
 	"github.com/mirrorz-org/mirrorz-302/pkg/logging"
 	"github.com/mirrorz-org/mirrorz-302/pkg/mirrorzdb"
+	"github.com/mirrorz-org/mirrorz-302/pkg/proxyproto"
 	"github.com/mirrorz-org/mirrorz-302/pkg/requestmeta"
 	"github.com/mirrorz-org/mirrorz-302/pkg/scoring"
+	"github.com/mirrorz-org/mirrorz-302/pkg/tlscert"
 	"github.com/mirrorz-org/mirrorz-302/pkg/tracing"
+	"github.com/mirrorz-org/mirrorz-302/pkg/watcher"
 )
 
 type Config struct {
 	InfluxDB          influxdb.Config `json:"influxdb"`
+	StatusSource      string          `json:"status-source"` // "influxdb" (default), "static" or "snapshot"
+	StatusFile        string          `json:"status-file"`   // used by "static" and "snapshot"
+	PrefetchInterval  int             `json:"prefetch-interval"`
+	MaxStaleness      int             `json:"max-staleness"`
+	MaxAge            int             `json:"max-age"`
+	SkipStatus        []string        `json:"skip-status"` // mirrorz status letters to skip, defaults to DefaultSkipStatus
+	QueryTimeout      int             `json:"query-timeout"`
+	BreakerThreshold  int             `json:"breaker-threshold"`
+	BreakerCooldown   int             `json:"breaker-cooldown"`
+	GeoProvider       string          `json:"geo-provider"` // "ipip" (default) or "mmdb"
 	IPDBFile          string          `json:"ipdb-file"`
+	MMDBFile          string          `json:"mmdb-file"`
+	ASNDBFile         string          `json:"asn-db-file"`
+	GeoTableFile      string          `json:"geo-table-file"` // extra regions, YAML or CSV
+	ISPFile           string          `json:"isp-file"`       // extra ISPs and aliases, YAML
 	HTTPBindAddress   string          `json:"http-bind-address"`
+	HTTPSBindAddress  string          `json:"https-bind-address"`
+	TLSCertFile       string          `json:"tls-cert-file"`
+	TLSKeyFile        string          `json:"tls-key-file"`
+	ShutdownTimeout   int             `json:"shutdown-timeout"` // defaults to DefaultShutdownTimeout
+	TrustedProxies    []string        `json:"trusted-proxies"`  // CIDRs or IPs, defaults to loopback
+	ProxyProtocol     bool            `json:"proxy-protocol"`   // accept PROXY headers from trusted proxies
 	MirrorZDDirectory string          `json:"mirrorz-d-directory"`
+	MirrorZDThreshold int             `json:"mirrorz-d-error-threshold"` // files failing to load that keep the current mirrorz.d, 0 to disable
+	LabelConflict     string          `json:"label-conflict"`            // "first-wins" (default), "reject" or "namespace"
 	Homepage          string          `json:"homepage"`
 	DomainLength      int             `json:"domain-length"`
 	CacheTime         int             `json:"cache-time"`
 	LogDirectory      string          `json:"log-directory"`
+	WatchFiles        bool            `json:"watch-files"` // reload files on change
 }
 
 type Server struct {
 	// feature providers
 	resolved *caching.ResolveCache
 	mirrorzd *mirrorzdb.MirrorZDatabase
-	influx   *influxdb.Source
-	meta     *requestmeta.Parser
+	geo      geo.Provider
 
-	// saved config
-	logDir      string
-	mirrorzdDir string
-	homepage    string
+	// settings that can be replaced by ApplyConfig
+	cur         atomic.Pointer[settings]
+	applyMu     sync.Mutex // serializes ApplyConfig
+	config      Config     // last applied config
+	prefetching bool       // StartPrefetch has been called
+
+	// status sources replaced by ApplyConfig and not closed yet, guarded by applyMu
+	retired []*retiredSource
+
+	// saved config, applied at startup only
+	geoFile    string
+	geoTable   string
+	ispFile    string
+	proxyProto bool
+
+	// certificate for HTTPS, nil if not configured
+	tlsCert *tlscert.Store
+
+	// running http servers, for Shutdown
+	serversMu sync.Mutex
+	servers   []*http.Server
+	shutdown  bool
+
+	// file watchers
+	watchFiles      bool
+	watchers        []*watcher.Watcher
+	mirrorzdWatcher *watcher.Watcher // follows mirrorz-d-directory, guarded by applyMu
 
 	// http muxes
 	handler, apiHandler http.Handler
@@ -51,34 +107,94 @@ type Server struct {
 
 const ApiPrefix = requestmeta.ApiPrefix
 
-func NewServer(config Config) *Server {
+// watchDebounce is the quiet time after a file change before reloading.
+const watchDebounce = 2 * time.Second
+
+// DefaultShutdownTimeout is how long in-flight requests are waited for on shutdown.
+const DefaultShutdownTimeout = 10 * time.Second
+
+// DefaultSkipStatus skips mirrors whose mirrorz status is failed or unknown.
+var DefaultSkipStatus = []string{"F", "U"}
+
+// NewServer returns a server for config.
+// Settings that cannot be applied are errors, as they are rejected by Config.Validate.
+func NewServer(config Config) (*Server, error) {
+	provider, err := geo.NewProvider(config.GeoProvider)
+	if err != nil {
+		return nil, fmt.Errorf("geo-provider: %w", err)
+	}
+	geoFile := config.IPDBFile
+	if _, ok := provider.(*geo.MMDB); ok {
+		geoFile = config.MMDBFile
+	}
+
 	s := &Server{
 		resolved: caching.NewResolveCache(time.Duration(config.CacheTime) * time.Second),
 		mirrorzd: mirrorzdb.NewMirrorZDatabase(),
-		influx:   influxdb.NewSourceFromConfig(config.InfluxDB),
-		meta: &requestmeta.Parser{
-			DomainLength: config.DomainLength,
-		},
+		geo:      provider,
+		config:   config,
 
-		logDir:      config.LogDirectory,
-		mirrorzdDir: config.MirrorZDDirectory,
+		geoFile:    geoFile,
+		geoTable:   config.GeoTableFile,
+		ispFile:    config.ISPFile,
+		watchFiles: config.WatchFiles,
+		proxyProto: config.ProxyProtocol,
 
 		resolveLogger: logging.GetLogger("resolve"),
 		failLogger:    logging.GetLogger("fail"),
 		errorLogger:   logging.GetLogger("error"),
-
-		homepage: config.Homepage,
 	}
+	if config.TLSCertFile != "" {
+		s.tlsCert = tlscert.NewStore(config.TLSCertFile, config.TLSKeyFile)
+	}
+	set, err := s.newSettings(config, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.cur.Store(set)
+	s.mirrorzd.SetConflictPolicy(set.labelConflict)
+	s.mirrorzd.SetErrorThreshold(set.mirrorzdThreshold)
 	s.buildHandlers()
-	return s
+	return s, nil
+}
+
+// buildStatusSource creates the MirrorStatusSource selected by config.
+func buildStatusSource(set *settings, config Config) {
+	switch config.StatusSource {
+	case "static":
+		set.statusBase = influxdb.NewStaticSource(nil)
+	case "snapshot":
+		set.statusBase = influxdb.NewSnapshotSource(config.StatusFile)
+	default:
+		set.statusBase = influxdb.NewSourceFromConfig(config.InfluxDB)
+	}
+	set.status = set.statusBase
+
+	if src, ok := set.status.(influxdb.PrefetchableSource); ok && config.PrefetchInterval > 0 {
+		set.prefetch = influxdb.NewPrefetchSource(src, time.Duration(config.PrefetchInterval)*time.Second)
+		set.status = set.prefetch
+	}
+	if config.QueryTimeout > 0 || config.BreakerThreshold > 0 {
+		set.status = influxdb.NewBreakerSource(set.status,
+			time.Duration(config.QueryTimeout)*time.Second,
+			config.BreakerThreshold,
+			time.Duration(config.BreakerCooldown)*time.Second)
+	}
+	if config.MaxStaleness > 0 {
+		set.status = influxdb.NewStaleSource(set.status, time.Duration(config.MaxStaleness)*time.Second)
+	}
 }
 
-var logContexts = []string{"resolve", "fail", "gc", "ipip", "parser", "error"}
+var logContexts = []string{"resolve", "fail", "gc", "ipip", "parser", "status", "watcher", "proxyproto", "error"}
 
 func (s *Server) InitLoggers() error {
+	return initLoggers(s.settings().logDir)
+}
+
+func initLoggers(logDir string) error {
 	defer runtime.GC() // trigger finalizers on released *os.File's
 	for _, context := range logContexts {
-		err := logging.SetContextFile(context, filepath.Join(s.logDir, context+".log"))
+		err := logging.SetContextFile(context, filepath.Join(logDir, context+".log"))
 		if err != nil {
 			return err
 		}
@@ -86,8 +202,228 @@ func (s *Server) InitLoggers() error {
 	return nil
 }
 
+// Listen listens on a TCP address,
+// reading PROXY headers from trusted proxies if enabled.
+func (s *Server) Listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return s.WrapListener(ln, false)
+}
+
+// ListenTLS listens on a TCP address for HTTPS.
+func (s *Server) ListenTLS(addr string) (net.Listener, error) {
+	if s.tlsCert == nil {
+		return nil, errors.New("no tls-cert-file configured")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return s.WrapListener(ln, true)
+}
+
+// WrapListener prepares a listener, e.g. one inherited by socket activation.
+// PROXY headers are read before the TLS handshake, if enabled.
+func (s *Server) WrapListener(ln net.Listener, useTLS bool) (net.Listener, error) {
+	if useTLS && s.tlsCert == nil {
+		ln.Close()
+		return nil, errors.New("no tls-cert-file configured")
+	}
+	if s.proxyProto {
+		ln = proxyproto.NewListener(ln, func(ip net.IP) bool {
+			return s.settings().meta.Trusted(ip)
+		})
+	}
+	if useTLS {
+		ln = tls.NewListener(ln, s.tlsCert.TLSConfig())
+	}
+	return ln, nil
+}
+
+// LoadTLS (re)loads the HTTPS certificate, if configured.
+func (s *Server) LoadTLS() error {
+	if s.tlsCert == nil {
+		return nil
+	}
+	return s.tlsCert.Load()
+}
+
+// Serve serves HTTP requests on a listener until Shutdown is called,
+// in which case http.ErrServerClosed is returned.
+func (s *Server) Serve(ln net.Listener) error {
+	srv := &http.Server{
+		Handler:     s,
+		ConnContext: proxyproto.ConnContext,
+	}
+	s.serversMu.Lock()
+	if s.shutdown {
+		s.serversMu.Unlock()
+		ln.Close()
+		return http.ErrServerClosed
+	}
+	s.servers = append(s.servers, srv)
+	s.serversMu.Unlock()
+	return srv.Serve(ln)
+}
+
+// Shutdown stops accepting requests, waits for in-flight requests until ctx is done,
+// then stops background work and closes the status source, including replaced ones.
+// Connections still open when ctx is done are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.serversMu.Lock()
+	servers := s.servers
+	s.servers = nil
+	s.shutdown = true
+	s.serversMu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(servers))
+	for i, srv := range servers {
+		wg.Add(1)
+		go func(i int, srv *http.Server) {
+			defer wg.Done()
+			if errs[i] = srv.Shutdown(ctx); errs[i] != nil {
+				srv.Close()
+			}
+		}(i, srv)
+	}
+	wg.Wait()
+
+	s.StopWatchers()
+	s.resolved.StopGCTicker()
+	set := s.settings()
+	if set.prefetch != nil {
+		set.prefetch.Stop()
+	}
+	closeSource(set.statusBase)
+	s.closeRetired()
+	return errors.Join(errs...)
+}
+
 func (s *Server) LoadMirrorZD() error {
-	return s.mirrorzd.Load(s.mirrorzdDir)
+	return s.mirrorzd.Load(s.settings().mirrorzdDir)
+}
+
+// LoadGeo loads the geo table, the ISP catalogue and the database of the geo provider, if configured.
+// A file failing to load does not prevent loading the others.
+func (s *Server) LoadGeo() error {
+	var errs []error
+	if s.geoTable != "" {
+		errs = append(errs, geo.LoadGeoTable(s.geoTable))
+	}
+	if s.ispFile != "" {
+		errs = append(errs, geo.LoadISPCatalogue(s.ispFile))
+	}
+	if s.geoFile != "" {
+		errs = append(errs, s.geo.Load(s.geoFile))
+	}
+	return errors.Join(errs...)
+}
+
+// StartWatchers reloads files on change, if enabled.
+func (s *Server) StartWatchers() error {
+	if !s.watchFiles {
+		return nil
+	}
+	s.applyMu.Lock()
+	err := s.watchMirrorZD(s.settings().mirrorzdDir)
+	s.applyMu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, file := range []string{s.geoTable, s.ispFile, s.geoFile} {
+		if file == "" {
+			continue
+		}
+		// mirrorz.d is checked against the geo tables and ISP catalogue, but not the IP database
+		reloadMirrorZD := file != s.geoFile
+		w, err := watcher.WatchFile(file, watchDebounce, func() {
+			if err := s.LoadGeo(); err != nil {
+				s.errorLogger.Errorf("Error reloading geo data: %v\n", err)
+			}
+			if !reloadMirrorZD {
+				return
+			}
+			if err := s.LoadMirrorZD(); err != nil {
+				s.errorLogger.Errorf("Error reloading mirrorz.d: %v\n", err)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("watch %s: %w", file, err)
+		}
+		s.watchers = append(s.watchers, w)
+	}
+	if s.tlsCert != nil {
+		for _, file := range []string{s.tlsCert.CertFile, s.tlsCert.KeyFile} {
+			w, err := watcher.WatchFile(file, watchDebounce, func() {
+				if err := s.LoadTLS(); err != nil {
+					s.errorLogger.Errorf("Error reloading TLS certificate: %v\n", err)
+				}
+			})
+			if err != nil {
+				return fmt.Errorf("watch %s: %w", file, err)
+			}
+			s.watchers = append(s.watchers, w)
+		}
+	}
+	return nil
+}
+
+// watchMirrorZD reloads mirrorz.d on changes to the .json files in dir,
+// replacing the watcher of the previous directory. The caller holds applyMu.
+func (s *Server) watchMirrorZD(dir string) error {
+	if s.mirrorzdWatcher != nil {
+		s.mirrorzdWatcher.Close()
+		s.mirrorzdWatcher = nil
+	}
+	w, err := watcher.Watch(dir, func(name string) bool {
+		return strings.HasSuffix(name, ".json")
+	}, watchDebounce, func() {
+		if err := s.LoadMirrorZD(); err != nil {
+			s.errorLogger.Errorf("Error reloading mirrorz.d: %v\n", err)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("watch %s: %w", dir, err)
+	}
+	s.mirrorzdWatcher = w
+	return nil
+}
+
+// StopWatchers stops all file watchers.
+func (s *Server) StopWatchers() {
+	s.applyMu.Lock()
+	if s.mirrorzdWatcher != nil {
+		s.mirrorzdWatcher.Close()
+		s.mirrorzdWatcher = nil
+	}
+	s.applyMu.Unlock()
+	for _, w := range s.watchers {
+		w.Close()
+	}
+	s.watchers = nil
+}
+
+// LoadStatus (re)loads the status file for sources that read one.
+func (s *Server) LoadStatus() error {
+	return loadStatus(s.settings())
+}
+
+func loadStatus(set *settings) (err error) {
+	switch src := set.statusBase.(type) {
+	case *influxdb.SnapshotSource:
+		err = src.Reload()
+	case *influxdb.StaticSource:
+		if set.statusFile != "" {
+			err = src.Load(set.statusFile)
+		}
+	}
+	if err == nil && set.prefetch != nil {
+		err = set.prefetch.Refresh(context.Background())
+	}
+	return
 }
 
 func (s *Server) buildHandlers() {
@@ -95,6 +431,9 @@ func (s *Server) buildHandlers() {
 	prefix := ApiPrefix + "scoring"
 	apiMux.Handle(prefix, http.StripPrefix(prefix, http.HandlerFunc(s.handleScoringAPI)))
 	apiMux.Handle(prefix+"/", http.StripPrefix(prefix, http.HandlerFunc(s.handleScoringAPI)))
+	apiMux.HandleFunc(ApiPrefix+"matrix", s.handleMatrixAPI)
+	apiMux.HandleFunc(ApiPrefix+"lint", s.handleLintAPI)
+	apiMux.HandleFunc(ApiPrefix+"conflicts", s.handleConflictsAPI)
 	s.apiHandler = apiMux
 
 	mainMux := http.NewServeMux()
@@ -110,9 +449,10 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // handleRedirect handles a regular mirrorz-302 request.
 func (s *Server) handleRedirect(w http.ResponseWriter, r *http.Request) {
+	set := s.settings()
 	if r.URL.Path == "/" {
-		labels := s.meta.Labels(r)
-		scheme := s.meta.Scheme(r)
+		labels := set.meta.Labels(r)
+		scheme := set.meta.Scheme(r)
 		if len(labels) != 0 {
 			resolve, ok := s.mirrorzd.ResolveLabel(labels[len(labels)-1])
 			if ok {
@@ -120,14 +460,14 @@ func (s *Server) handleRedirect(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 		}
-		http.Redirect(w, r, fmt.Sprintf("%s://%s", scheme, s.homepage), http.StatusFound)
+		http.Redirect(w, r, fmt.Sprintf("%s://%s", scheme, set.homepage), http.StatusFound)
 		return
 	}
 
 	_, traceEnabled := r.URL.Query()["trace"]
 	tracer := tracing.NewTracer(traceEnabled)
 	ctx := context.WithValue(r.Context(), tracing.Key, tracer)
-	meta := s.meta.Parse(r)
+	meta := set.meta.Parse(r)
 	url, err := s.Resolve(ctx, meta)
 
 	if traceEnabled {
@@ -153,7 +493,7 @@ func (s *Server) handleScoringAPI(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Method %s is not supported", r.Method), http.StatusMethodNotAllowed)
 		return
 	}
-	meta := s.meta.Parse(r)
+	meta := s.settings().meta.Parse(r)
 
 	ctx := context.WithValue(r.Context(), tracing.Key, tracing.NewTracer(false))
 	scores := s.ResolveBest(ctx, meta)
@@ -165,3 +505,107 @@ func (s *Server) handleScoringAPI(w http.ResponseWriter, r *http.Request) {
 		s.errorLogger.Errorf("Error encoding response: %v", err)
 	}
 }
+
+// maxMatrixCNames is the most cnames a matrix API request may ask for.
+const maxMatrixCNames = 100
+
+type MatrixAPIResponse struct {
+	// Delta of each mirror, by cname and abbr
+	Matrix map[string]map[string]int `json:"matrix"`
+}
+
+// handleMatrixAPI reports the freshness of every mirror for each cname.
+//
+// Cnames can be selected with one or more "cname" query parameters, defaulting to all.
+func (s *Server) handleMatrixAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, fmt.Sprintf("Method %s is not supported", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	cnames := r.URL.Query()["cname"]
+	if len(cnames) > maxMatrixCNames {
+		http.Error(w, fmt.Sprintf("At most %d cnames are allowed", maxMatrixCNames), http.StatusBadRequest)
+		return
+	}
+	if len(cnames) == 0 {
+		cnames = s.mirrorzd.CNames()
+	} else {
+		// only cnames in mirrorz.d reach the status source, as in Resolve
+		known := make([]string, 0, len(cnames))
+		for _, cname := range cnames {
+			if _, ok := s.mirrorzd.Query(mirrorzdb.NormalizeCname(cname)); ok && !slices.Contains(known, cname) {
+				known = append(known, cname)
+			}
+		}
+		cnames = known
+	}
+
+	ctx := context.WithValue(r.Context(), tracing.Key, tracing.NewTracer(false))
+	m, _ := s.queryMatrix(ctx, cnames)
+	if m == nil {
+		http.Error(w, "Status source unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	resp := &MatrixAPIResponse{Matrix: make(map[string]map[string]int, len(m))}
+	for cname, res := range m {
+		row := make(map[string]int, len(res))
+		for _, item := range res {
+			row[item.Mirror] = item.Value
+		}
+		resp.Matrix[cname] = row
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.errorLogger.Errorf("Error encoding response: %v", err)
+	}
+}
+
+type LintAPIResponse struct {
+	// Problems found in the loaded mirrorz.d files
+	Warnings []string `json:"warnings"`
+	// ISP names from the IP database missing from the ISP catalogue, and how often they were seen
+	UnknownISPs map[string]int `json:"unknown_isps"`
+}
+
+// handleLintAPI reports the problems found when loading mirrorz.d.
+func (s *Server) handleLintAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, fmt.Sprintf("Method %s is not supported", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	resp := &LintAPIResponse{Warnings: s.mirrorzd.Warnings(), UnknownISPs: geo.UnknownISPs()}
+	if resp.Warnings == nil {
+		resp.Warnings = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.errorLogger.Errorf("Error encoding response: %v", err)
+	}
+}
+
+type ConflictsAPIResponse struct {
+	// Labels declared by more than one site, and how they were resolved
+	Conflicts []mirrorzdb.Conflict `json:"conflicts"`
+}
+
+// handleConflictsAPI reports the label conflicts between sites in mirrorz.d.
+func (s *Server) handleConflictsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, fmt.Sprintf("Method %s is not supported", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	resp := &ConflictsAPIResponse{Conflicts: s.mirrorzd.Conflicts()}
+	if resp.Conflicts == nil {
+		resp.Conflicts = []mirrorzdb.Conflict{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.errorLogger.Errorf("Error encoding response: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mirrorz-org/mirrorz-302/pkg/influxdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatrixAPI(t *testing.T) {
+	as := assert.New(t)
+	s, src := newTestServer(t)
+	src.Store("debian", influxdb.Result{{Mirror: "TEST", Value: -10, Path: "/debian"}})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/api/matrix", nil))
+	as.Equal(http.StatusOK, w.Code)
+	var resp MatrixAPIResponse
+	as.Nil(json.NewDecoder(w.Body).Decode(&resp))
+	as.Equal(map[string]map[string]int{"debian": {"TEST": -10}}, resp.Matrix)
+
+	// unknown cnames are not queried
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/api/matrix?cname=ubuntu&cname=debian&cname=debian", nil))
+	resp = MatrixAPIResponse{}
+	as.Nil(json.NewDecoder(w.Body).Decode(&resp))
+	as.Equal(map[string]map[string]int{"debian": {"TEST": -10}}, resp.Matrix)
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/api/matrix?cname=debian"+strings.Repeat("&cname=x", maxMatrixCNames), nil))
+	as.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestScoringAPIDelta(t *testing.T) {
+	as := assert.New(t)
+	s, src := newTestServer(t)
+	src.Store("debian", influxdb.Result{{Mirror: "TEST", Value: -10, Path: "/debian"}})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/api/scoring", nil)
+	r.Header.Set("X-Real-IP", "192.0.2.1")
+	s.ServeHTTP(w, r)
+	as.Equal(http.StatusOK, w.Code)
+	var resp ScoringAPIResponse
+	as.Nil(json.NewDecoder(w.Body).Decode(&resp))
+	if as.Len(resp.Scores, 1) {
+		as.Equal(-10, resp.Scores[0].Delta)
+	}
+}
+
+func TestMedian(t *testing.T) {
+	as := assert.New(t)
+	_, ok := median(nil)
+	as.False(ok)
+	for _, c := range []struct {
+		values []int
+		median int
+	}{
+		{[]int{-3}, -3},
+		{[]int{-1, -3}, -2},
+		{[]int{-5, 0, -30}, -5},
+	} {
+		m, ok := median(c.values)
+		as.True(ok)
+		as.Equal(c.median, m, "%v", c.values)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	as := assert.New(t)
+	s, _ := newTestServer(t)
+	s.StartResolvedTicker()
+
+	ln, err := s.Listen("127.0.0.1:0")
+	as.Nil(err)
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ln) }()
+
+	as.Eventually(func() bool {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/api/matrix")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	as.Nil(s.Shutdown(ctx))
+	as.ErrorIs(<-served, http.ErrServerClosed)
+
+	ln, err = s.Listen("127.0.0.1:0")
+	as.Nil(err)
+	as.ErrorIs(s.Serve(ln), http.ErrServerClosed, "Serve after Shutdown should not serve")
+}
+
+func TestLintAPI(t *testing.T) {
+	as := assert.New(t)
+	s, _ := newTestServer(t, `{"site": {"abbr": "TEST"}, "endpoints": []}`)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/api/lint", nil))
+	as.Equal(http.StatusOK, w.Code)
+	var resp LintAPIResponse
+	as.Nil(json.NewDecoder(w.Body).Decode(&resp))
+	as.Equal([]string{"test.json: site abbr TEST is also used by extra0.json"}, resp.Warnings)
+	as.NotNil(resp.UnknownISPs, "unknown_isps should be reported even if empty")
+}
+
+func TestConflictsAPI(t *testing.T) {
+	as := assert.New(t)
+	s, _ := newTestServer(t, `{"site": {"abbr": "OTHER"}, "endpoints": [{"label": "test", "resolve": "other.example.edu.cn"}]}`)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/api/conflicts", nil))
+	as.Equal(http.StatusOK, w.Code)
+	as.JSONEq(`{"conflicts": [{"label": "test", "sites": ["OTHER", "TEST"], "policy": "first-wins", "winner": "OTHER"}]}`, w.Body.String())
+}
@@ -0,0 +1,71 @@
+// Package tlscert keeps a TLS certificate that can be reloaded while serving.
+package tlscert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// A Store holds the certificate loaded from a pair of PEM files.
+type Store struct {
+	CertFile, KeyFile string
+
+	cert atomic.Pointer[tls.Certificate]
+}
+
+// NewStore returns a Store with no certificate loaded.
+func NewStore(certFile, keyFile string) *Store {
+	return &Store{CertFile: certFile, KeyFile: keyFile}
+}
+
+// Load loads the certificate and key files.
+// On error, the current certificate is kept.
+func (s *Store) Load() error {
+	cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate %s: %w", s.CertFile, err)
+	}
+	if cert.Leaf == nil {
+		// Go < 1.23 does not fill Leaf
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("load certificate %s: %w", s.CertFile, err)
+		}
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return fmt.Errorf("load certificate %s: expired at %s", s.CertFile, cert.Leaf.NotAfter)
+	}
+	s.cert.Store(&cert)
+	return nil
+}
+
+// NotAfter returns the expiry time of the current certificate,
+// or the zero time if none is loaded.
+func (s *Store) NotAfter() time.Time {
+	cert := s.cert.Load()
+	if cert == nil {
+		return time.Time{}
+	}
+	return cert.Leaf.NotAfter
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate.
+func (s *Store) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := s.cert.Load()
+	if cert == nil {
+		return nil, errors.New("no certificate loaded")
+	}
+	return cert, nil
+}
+
+// TLSConfig returns a tls.Config serving the current certificate.
+func (s *Store) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: s.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+		MinVersion:     tls.VersionTLS12,
+	}
+}
@@ -0,0 +1,68 @@
+package tlscert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCert writes a self-signed certificate expiring at notAfter.
+func writeCert(t *testing.T, certFile, keyFile string, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mirrors.example.edu.cn"},
+		NotBefore:    notAfter.Add(-48 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+}
+
+func TestStore(t *testing.T) {
+	as := assert.New(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	s := NewStore(certFile, keyFile)
+
+	as.NotNil(s.Load())
+	_, err := s.GetCertificate(nil)
+	as.NotNil(err)
+
+	expiry := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	writeCert(t, certFile, keyFile, expiry)
+	as.Nil(s.Load())
+	as.True(expiry.Equal(s.NotAfter()))
+	cert, err := s.GetCertificate(nil)
+	as.Nil(err)
+	as.NotNil(cert)
+
+	// an expired or broken certificate keeps the current one
+	writeCert(t, certFile, keyFile, time.Now().Add(-time.Hour))
+	as.NotNil(s.Load())
+	as.True(expiry.Equal(s.NotAfter()))
+	os.WriteFile(keyFile, []byte("garbage"), 0600)
+	as.NotNil(s.Load())
+	as.True(expiry.Equal(s.NotAfter()))
+}
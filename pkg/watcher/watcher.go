@@ -0,0 +1,89 @@
+package watcher
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mirrorz-org/mirrorz-302/pkg/logging"
+)
+
+var logger = logging.GetLogger("watcher")
+
+// A Watcher calls a function after files in a directory change.
+//
+// Bursts of changes, like an editor saving a file or rsync updating a directory,
+// are coalesced into a single call once no change is seen for the debounce duration.
+type Watcher struct {
+	w    *fsnotify.Watcher
+	done chan struct{}
+}
+
+// Watch watches the directory dir.
+// Changes to files for which match returns true trigger fn, which is never called concurrently.
+// A nil match accepts all files.
+func Watch(dir string, match func(name string) bool, debounce time.Duration, fn func()) (*Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Add(dir); err != nil {
+		w.Close()
+		return nil, err
+	}
+	watcher := &Watcher{w: w, done: make(chan struct{})}
+	go watcher.loop(match, debounce, fn)
+	return watcher, nil
+}
+
+// WatchFile watches a single file.
+//
+// The containing directory is watched, so that replacing the file by renaming is also seen.
+func WatchFile(path string, debounce time.Duration, fn func()) (*Watcher, error) {
+	path = filepath.Clean(path)
+	return Watch(filepath.Dir(path), func(name string) bool {
+		return filepath.Clean(name) == path
+	}, debounce, fn)
+}
+
+func (w *Watcher) loop(match func(name string) bool, debounce time.Duration, fn func()) {
+	defer close(w.done)
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	for {
+		select {
+		case event, ok := <-w.w.Events:
+			if !ok {
+				timer.Stop()
+				return
+			}
+			if event.Op == fsnotify.Chmod || (match != nil && !match(event.Name)) {
+				continue
+			}
+			logger.Debugf("Watcher: %s\n", event)
+			// drop a tick not received yet, so that fn is not called early and then again
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(debounce)
+		case err, ok := <-w.w.Errors:
+			if !ok {
+				timer.Stop()
+				return
+			}
+			logger.Errorf("Watcher error: %v\n", err)
+		case <-timer.C:
+			fn()
+		}
+	}
+}
+
+// Close stops watching and waits for a running fn to return.
+func (w *Watcher) Close() error {
+	err := w.w.Close()
+	<-w.done
+	return err
+}
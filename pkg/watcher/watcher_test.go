@@ -0,0 +1,63 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchFile(t *testing.T) {
+	as := assert.New(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "watched")
+	var calls atomic.Int32
+	w, err := WatchFile(path, 50*time.Millisecond, func() { calls.Add(1) })
+	as.Nil(err)
+	defer w.Close()
+
+	// other files are ignored
+	as.Nil(os.WriteFile(filepath.Join(dir, "other"), []byte("x"), 0644))
+	time.Sleep(200 * time.Millisecond)
+	as.Equal(int32(0), calls.Load())
+
+	// a burst of writes is coalesced
+	for i := 0; i < 5; i++ {
+		as.Nil(os.WriteFile(path, []byte{byte(i)}, 0644))
+	}
+	as.Eventually(func() bool { return calls.Load() == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	// replacing by rename is seen
+	tmp := filepath.Join(dir, "watched.tmp")
+	as.Nil(os.WriteFile(tmp, []byte("new"), 0644))
+	as.Nil(os.Rename(tmp, path))
+	as.Eventually(func() bool { return calls.Load() == 2 }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestDebounceBoundary(t *testing.T) {
+	as := assert.New(t)
+	const debounce = 50 * time.Millisecond
+	events := make(chan fsnotify.Event, 2)
+	w := &Watcher{w: &fsnotify.Watcher{Events: events}, done: make(chan struct{})}
+	var calls atomic.Int32
+	// the second event is matched only after the timer of the first one fired,
+	// as if it arrived just after the debounce duration
+	match := func(name string) bool {
+		if name == "late" {
+			time.Sleep(2 * debounce)
+		}
+		return true
+	}
+	go w.loop(match, debounce, func() { calls.Add(1) })
+
+	events <- fsnotify.Event{Name: "early", Op: fsnotify.Write}
+	events <- fsnotify.Event{Name: "late", Op: fsnotify.Write}
+	time.Sleep(5 * debounce)
+	close(events)
+	<-w.done
+	as.Equal(int32(1), calls.Load())
+}